@@ -1,19 +1,36 @@
 package main
 
 import (
+	"context"
 	"crswty.com/cms/datastore"
+	"crswty.com/cms/publisher"
 	"crswty.com/cms/server"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/spf13/viper"
 	"net/http"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 const appName = "cms"
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "hash-key" {
+		fmt.Println(server.HashKey(os.Args[2]))
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "hash-password" {
+		hash, err := server.HashPassword(os.Args[2])
+		if err != nil {
+			panic(fmt.Errorf("unable to hash password: %w", err))
+		}
+		fmt.Println(hash)
+		return
+	}
+
 	//TODO work out how to handle IDs
-	//TODO validate schema on start
 	v := viper.New()
 
 	v.AddConfigPath(fmt.Sprintf("/etc/%s", appName))
@@ -36,16 +53,72 @@ func main() {
 		panic(fmt.Errorf("unable to create provider: %w", err))
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		err = server.Reindex(store, typesFromConfig)
+		if err != nil {
+			panic(fmt.Errorf("unable to rebuild indexes: %w", err))
+		}
+		fmt.Println("indexes rebuilt")
+		return
+	}
+
+	auth, err := getAuthFromConfig(v)
+	if err != nil {
+		panic(fmt.Errorf("unable to parse auth config: %w", err))
+	}
+
+	audit, err := getAuditSinkFromConfig(v, store)
+	if err != nil {
+		panic(fmt.Errorf("unable to create audit sink: %w", err))
+	}
+
+	webhooks, err := getWebhooksFromConfig(v)
+	if err != nil {
+		panic(fmt.Errorf("unable to parse webhook config: %w", err))
+	}
+
+	publishers, err := getPublishersFromConfig(v)
+	if err != nil {
+		panic(fmt.Errorf("unable to create publishers: %w", err))
+	}
+
 	v.SetDefault("adminAssets", "./web")
 
 	r := chi.NewRouter()
-	server.Server{
-		Config: server.Config{
-			Types:       typesFromConfig,
-			AdminAssets: v.GetString("adminAssets"),
+	srv, err := server.New(
+		server.Config{
+			Types:            typesFromConfig,
+			AdminAssets:      v.GetString("adminAssets"),
+			MaxExpandDepth:   v.GetInt("maxExpandDepth"),
+			Auth:             auth,
+			ContentPath:      v.GetString("contentPath"),
+			ContentMaxAge:    v.GetDuration("contentMaxAge"),
+			ScheduleInterval: v.GetDuration("scheduleInterval"),
+			SweepInterval:    v.GetDuration("sweepInterval"),
+			Audit:            audit,
+			EventBuffer:      v.GetInt("eventBuffer"),
+			Webhooks:         webhooks,
+			WebhookInterval:  v.GetDuration("webhookInterval"),
+			WebhookBackoff:   v.GetDuration("webhookBackoff"),
+			WebhookAttempts:  v.GetInt("webhookAttempts"),
+			Publishers:       publishers,
+			Outbox:           v.GetBool("outbox"),
+			OutboxInterval:   v.GetDuration("outboxInterval"),
 		},
-		DataStore: store,
-	}.Start(r)
+		store,
+	)
+	if err != nil {
+		panic(fmt.Errorf("unable to set up server: %w", err))
+	}
+	err = srv.Start(r)
+	if err != nil {
+		panic(fmt.Errorf("unable to start server: %w", err))
+	}
+	go srv.RunScheduler(context.Background())
+	go srv.RunSweeper(context.Background())
+	go srv.RunWebhooks(context.Background())
+	go srv.RunPublishers(context.Background())
+	go srv.RunOutbox(context.Background())
 
 	//TODO PORT var
 	port := "8080"
@@ -57,9 +130,19 @@ func main() {
 }
 
 type typeConfig []struct {
-	Name   string `json:"name"`
-	Id     string `json:"id"`
-	Schema string `json:"schema"`
+	Name           string        `json:"name"`
+	Id             string        `json:"id"`
+	Schema         string        `json:"schema"`
+	SchemaFile     string        `json:"schemaFile"`
+	Unique         []string      `json:"unique"`
+	Indexes        []string      `json:"indexes"`
+	Search         []string      `json:"search"`
+	Owner          string        `json:"owner"`
+	Public         bool          `json:"public"`
+	PublicFields   []string      `json:"publicFields"`
+	Workflow       string        `json:"workflow"`
+	SoftDelete     bool          `json:"softDelete"`
+	TrashRetention time.Duration `json:"trashRetention"`
 }
 
 func getTypesFromConfig(v *viper.Viper) ([]server.Type, error) {
@@ -71,9 +154,191 @@ func getTypesFromConfig(v *viper.Viper) ([]server.Type, error) {
 
 	var ts = make([]server.Type, 0)
 	for _, t := range types {
-		ts = append(ts, server.Type{Name: t.Name, Id: t.Id, Schema: t.Schema})
+		ts = append(ts, server.Type{
+			Name:           t.Name,
+			Id:             t.Id,
+			Schema:         t.Schema,
+			SchemaFile:     t.SchemaFile,
+			Unique:         t.Unique,
+			Indexes:        t.Indexes,
+			Search:         t.Search,
+			Owner:          t.Owner,
+			Public:         t.Public,
+			PublicFields:   t.PublicFields,
+			Workflow:       t.Workflow,
+			SoftDelete:     t.SoftDelete,
+			TrashRetention: t.TrashRetention,
+		})
+	}
+	return server.BundleSchemas(ts, filepath.Dir(v.ConfigFileUsed()))
+}
+
+type authConfig struct {
+	ApiKeys []struct {
+		Name        string              `json:"name"`
+		Hash        string              `json:"hash"`
+		Permissions map[string][]string `json:"permissions"`
+		Roles       []string            `json:"roles"`
+	} `json:"apiKeys"`
+	Jwt *struct {
+		JwksUrl    string        `json:"jwksUrl"`
+		Keys       []string      `json:"keys"`
+		Issuer     string        `json:"issuer"`
+		Audience   string        `json:"audience"`
+		Leeway     time.Duration `json:"leeway"`
+		RolesClaim string        `json:"rolesClaim"`
+	} `json:"jwt"`
+	Users []struct {
+		Name         string              `json:"name"`
+		PasswordHash string              `json:"passwordHash"`
+		Permissions  map[string][]string `json:"permissions"`
+		Roles        []string            `json:"roles"`
+	} `json:"users"`
+	SessionSecret string        `json:"sessionSecret"`
+	SessionTTL    time.Duration `json:"sessionTTL"`
+	Roles         map[string]struct {
+		Permissions map[string][]string `json:"permissions"`
+		Fields      map[string]struct {
+			Hidden    []string `json:"hidden"`
+			Protected []string `json:"protected"`
+		} `json:"fields"`
+	} `json:"roles"`
+}
+
+func getAuthFromConfig(v *viper.Viper) (server.AuthConfig, error) {
+	config := authConfig{}
+	err := v.UnmarshalKey("auth", &config)
+	if err != nil {
+		return server.AuthConfig{}, err
+	}
+
+	auth := server.AuthConfig{
+		APIKeys:       make([]server.APIKey, 0),
+		Users:         make([]server.User, 0),
+		SessionSecret: config.SessionSecret,
+		SessionTTL:    config.SessionTTL,
+	}
+	for _, key := range config.ApiKeys {
+		auth.APIKeys = append(auth.APIKeys, server.APIKey{
+			Name:        key.Name,
+			Hash:        key.Hash,
+			Permissions: scopes(key.Permissions),
+			Roles:       key.Roles,
+		})
+	}
+	for _, user := range config.Users {
+		auth.Users = append(auth.Users, server.User{
+			Name:         user.Name,
+			PasswordHash: user.PasswordHash,
+			Permissions:  scopes(user.Permissions),
+			Roles:        user.Roles,
+		})
+	}
+	if config.Jwt != nil {
+		auth.JWT = &server.JWTConfig{
+			JWKSURL:    config.Jwt.JwksUrl,
+			Keys:       config.Jwt.Keys,
+			Issuer:     config.Jwt.Issuer,
+			Audience:   config.Jwt.Audience,
+			Leeway:     config.Jwt.Leeway,
+			RolesClaim: config.Jwt.RolesClaim,
+		}
+	}
+	auth.Roles = map[string]server.Role{}
+	for name, role := range config.Roles {
+		fields := map[string]server.FieldRules{}
+		for typeName, rules := range role.Fields {
+			fields[typeName] = server.FieldRules{Hidden: rules.Hidden, Protected: rules.Protected}
+		}
+		auth.Roles[name] = server.Role{Permissions: scopes(role.Permissions), Fields: fields}
+	}
+	return auth, nil
+}
+
+func scopes(permissions map[string][]string) map[string][]server.Scope {
+	granted := map[string][]server.Scope{}
+	for typeName, names := range permissions {
+		for _, name := range names {
+			granted[typeName] = append(granted[typeName], server.Scope(name))
+		}
+	}
+	return granted
+}
+
+type webhookConfig []struct {
+	Name   string   `json:"name"`
+	Url    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Types  []string `json:"types"`
+	Events []string `json:"events"`
+}
+
+func getWebhooksFromConfig(v *viper.Viper) ([]server.Webhook, error) {
+	config := webhookConfig{}
+	err := v.UnmarshalKey("webhooks", &config)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]server.Webhook, 0)
+	for _, w := range config {
+		webhooks = append(webhooks, server.Webhook{Name: w.Name, URL: w.Url, Secret: w.Secret, Types: w.Types, Events: w.Events})
+	}
+	return webhooks, nil
+}
+
+type publisherConfig []struct {
+	Type            string `json:"type"`
+	Project         string `json:"project"`
+	Topic           string `json:"topic"`
+	CredentialsFile string `json:"credentialsFile"`
+}
+
+func getPublishersFromConfig(v *viper.Viper) ([]server.Publisher, error) {
+	config := publisherConfig{}
+	err := v.UnmarshalKey("publishers", &config)
+	if err != nil {
+		return nil, err
+	}
+
+	publishers := make([]server.Publisher, 0)
+	for _, p := range config {
+		switch p.Type {
+		case "pubsub":
+			pubsubConfig := publisher.PubSubConfig{Project: p.Project, Topic: p.Topic}
+			if p.CredentialsFile != "" {
+				credentialsFile := p.CredentialsFile
+				pubsubConfig.CredentialsFile = &credentialsFile
+			}
+			pubSub, err := publisher.NewPubSub(pubsubConfig)
+			if err != nil {
+				return nil, err
+			}
+			publishers = append(publishers, pubSub)
+		default:
+			return nil, fmt.Errorf("no publisher found with type: %s", p.Type)
+		}
+	}
+	return publishers, nil
+}
+
+func getAuditSinkFromConfig(v *viper.Viper, store server.DataProvider) (server.AuditSink, error) {
+	switch sink := v.GetString("audit.sink"); sink {
+	case "":
+		return nil, nil
+	case "provider":
+		return server.StoreAuditSink{DataStore: store}, nil
+	case "file":
+		path := v.GetString("audit.file")
+		if path == "" {
+			return nil, fmt.Errorf("the file audit sink needs audit.file")
+		}
+		return server.NewFileAuditSink(path), nil
+	case "stdout":
+		return server.WriterAuditSink{Writer: os.Stdout}, nil
+	default:
+		return nil, fmt.Errorf("no audit sink found with name: %s", sink)
 	}
-	return ts, nil
 }
 
 func getProviderFromConfig(v *viper.Viper, typesFromConfig []server.Type) (server.DataProvider, error) {
@@ -6,17 +6,28 @@ import (
 	"crswty.com/cms/server"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const maxConcurrentGets = 10
+
 type Gcs struct {
 	Client *storage.Client
 	Bucket string
+	// Versioned buckets keep noncurrent generations of objects, which serve as their history.
+	Versioned bool
 }
 
 type GcsConfig struct {
@@ -46,33 +57,59 @@ func NewGcs(config GcsConfig) (Gcs, error) {
 		return Gcs{}, fmt.Errorf("unable to create gcs client %w", err)
 	}
 
+	versioned := false
+	attrs, err := client.Bucket(config.Bucket).Attrs(context.TODO())
+	if err != nil {
+		log.Printf("unable to read attributes of bucket %s, history will be kept by the server: %s \n", config.Bucket, err)
+	} else {
+		versioned = attrs.VersioningEnabled
+	}
+
 	return Gcs{
-		Client: client,
-		Bucket: config.Bucket,
+		Client:    client,
+		Bucket:    config.Bucket,
+		Versioned: versioned,
 	}, nil
 }
 
 func (g Gcs) List(t server.Type) ([]server.Object, error) {
+	ids, err := g.ids(t)
+	if err != nil {
+		return nil, err
+	}
+
+	objs := make([]server.Object, 0)
+	for _, id := range ids {
+		//TODO cache list responses based on ETag
+		get, err := g.Get(t, id)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list item detail %s : %w", id, err)
+		}
+		objs = append(objs, get)
+	}
+	return objs, nil
+}
+
+func (g Gcs) ids(t server.Type) ([]string, error) {
+	// the delimiter leaves out nested objects such as indexes, which come back as prefixes without a name
 	objects := g.Client.Bucket(g.Bucket).Objects(context.TODO(), &storage.Query{
-		Prefix: fmt.Sprintf("%s/", t.Name),
+		Prefix:    fmt.Sprintf("%s/", t.Name),
+		Delimiter: "/",
 	})
-	objs := make([]server.Object, 0)
+	ids := make([]string, 0)
 	for {
 		next, err := objects.Next()
 		if err == iterator.Done {
-			return objs, nil
+			return ids, nil
 		}
 		if err != nil {
 			return nil, fmt.Errorf("unable to list item: %w", err)
 		}
 
-		//TODO cache list responses based on ETag
-		id := strings.TrimPrefix(next.Name, t.Name+"/") //TODO do this better
-		get, err := g.Get(t, id)
-		if err != nil {
-			return nil, fmt.Errorf("unable to list item detail %s : %w", id, err)
+		if next.Name == "" {
+			continue
 		}
-		objs = append(objs, get)
+		ids = append(ids, strings.TrimPrefix(next.Name, t.Name+"/")) //TODO do this better
 	}
 }
 
@@ -80,9 +117,13 @@ func (g Gcs) Get(t server.Type, id string) (server.Object, error) {
 	objectName := fmt.Sprintf("%s/%s", t.Name, id)
 	object := g.Client.Bucket(g.Bucket).Object(objectName)
 	reader, err := object.NewReader(context.TODO())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return server.Object{}, fmt.Errorf("gcs provider failed to find %s error: %w", objectName, server.ErrNotFound)
+	}
 	if err != nil {
 		return server.Object{}, fmt.Errorf("gcs provider failed to find  %s error: %w", objectName, err)
 	}
+	defer reader.Close()
 	bytes, err := io.ReadAll(reader)
 	if err != nil {
 		return server.Object{}, fmt.Errorf("gcs provider failed to read %s error: %w", objectName, err)
@@ -95,23 +136,114 @@ func (g Gcs) Get(t server.Type, id string) (server.Object, error) {
 	return data, nil
 }
 
+// GetMany fetches objects concurrently, as GCS has no batch download.
+func (g Gcs) GetMany(t server.Type, ids []string) (map[string]server.Object, error) {
+	type result struct {
+		id  string
+		obj server.Object
+		err error
+	}
+
+	results := make(chan result, len(ids))
+	limit := make(chan struct{}, maxConcurrentGets)
+	for _, id := range ids {
+		go func(id string) {
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			obj, err := g.Get(t, id)
+			results <- result{id: id, obj: obj, err: err}
+		}(id)
+	}
+
+	found := map[string]server.Object{}
+	var firstErr error
+	for range ids {
+		r := <-results
+		switch {
+		case errors.Is(r.err, server.ErrNotFound):
+		case r.err != nil && firstErr == nil:
+			firstErr = r.err
+		case r.err == nil:
+			found[r.id] = r.obj
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return found, nil
+}
+
+// Find lists the index markers for the value and loads the objects they point at. Markers are written
+// before and removed after the object itself, so objects no longer holding the value are filtered out.
+func (g Gcs) Find(t server.Type, field string, value string) ([]server.Object, error) {
+	prefix := indexPrefix(t, field, value)
+	markers := g.Client.Bucket(g.Bucket).Objects(context.TODO(), &storage.Query{Prefix: prefix})
+
+	ids := make([]string, 0)
+	for {
+		next, err := markers.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gcs provider failed to list index %s error: %w", prefix, err)
+		}
+		id, err := url.PathUnescape(strings.TrimPrefix(next.Name, prefix))
+		if err != nil {
+			return nil, fmt.Errorf("gcs provider found invalid index marker %s error: %w", next.Name, err)
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	found, err := g.GetMany(t, ids)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]server.Object, 0)
+	for _, id := range ids {
+		obj, ok := found[id]
+		if !ok {
+			continue
+		}
+		if current, indexed := server.IndexValue(obj[field]); indexed && current == value {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
 func (g Gcs) Create(t server.Type, id string, obj server.Object) error {
-	object := g.Client.Bucket(g.Bucket).Object(fmt.Sprintf("%s/%s", t.Name, id))
-	writer := object.NewWriter(context.TODO())
-	marshal, err := json.Marshal(obj)
+	old, err := g.previous(t, id)
 	if err != nil {
 		return fmt.Errorf("gcs provider failed to create id %s error: %w", id, err)
 	}
-	_, err = writer.Write(marshal)
+
+	marshal, err := json.Marshal(obj)
 	if err != nil {
 		return fmt.Errorf("gcs provider failed to create id %s error: %w", id, err)
 	}
-	err = writer.Close()
+
+	claimed, err := g.claimUnique(t, id, old, obj)
 	if err != nil {
-		return fmt.Errorf("gcs provider failed to create id %s error: %w", id, err)
+		return err
 	}
 
-	return nil
+	added, removed := indexChanges(t, id, old, obj)
+	for _, marker := range added {
+		err = g.write(marker, []byte{})
+		if err != nil {
+			g.releaseUnique(id, claimed)
+			return fmt.Errorf("gcs provider failed to index id %s error: %w", id, err)
+		}
+	}
+	err = g.write(fmt.Sprintf("%s/%s", t.Name, id), marshal)
+	if err != nil {
+		g.releaseUnique(id, claimed)
+		return fmt.Errorf("gcs provider failed to create id %s error: %w", id, err)
+	}
+	g.releaseUnique(id, uniqueChanges(t, old, obj))
+	return g.deleteMarkers(id, removed)
 }
 
 func (g Gcs) Update(t server.Type, id string, obj server.Object) error {
@@ -119,9 +251,356 @@ func (g Gcs) Update(t server.Type, id string, obj server.Object) error {
 }
 
 func (g Gcs) Delete(t server.Type, id string) error {
-	err := g.Client.Bucket(g.Bucket).Object(fmt.Sprintf("%s/%s", t.Name, id)).Delete(context.TODO())
+	old, err := g.previous(t, id)
 	if err != nil {
 		return fmt.Errorf("gcs provider failed to delete id %s error: %w", id, err)
 	}
+
+	err = g.Client.Bucket(g.Bucket).Object(fmt.Sprintf("%s/%s", t.Name, id)).Delete(context.TODO())
+	if err != nil {
+		return fmt.Errorf("gcs provider failed to delete id %s error: %w", id, err)
+	}
+
+	g.releaseUnique(id, uniqueChanges(t, old, nil))
+	_, removed := indexChanges(t, id, old, nil)
+	return g.deleteMarkers(id, removed)
+}
+
+// claimUnique creates a marker holding the id for each new unique value. The markers are written with a
+// DoesNotExist precondition so only one writer can claim a value, markers left behind by objects that no
+// longer hold the value are taken over. Returns the markers claimed so they can be released on failure.
+func (g Gcs) claimUnique(t server.Type, id string, old, obj server.Object) ([]string, error) {
+	claimed := make([]string, 0)
+	for _, field := range t.Unique {
+		value, ok := server.IndexValue(obj[field])
+		if !ok {
+			continue
+		}
+		if oldValue, hadOld := server.IndexValue(old[field]); hadOld && oldValue == value {
+			continue
+		}
+
+		name := uniqueName(t, field, value)
+		err := g.writeIf(name, []byte(id), storage.Conditions{DoesNotExist: true})
+		if isPreconditionFailed(err) {
+			err = g.takeOverUnique(t, id, field, value)
+		}
+		if err != nil {
+			g.releaseUnique(id, claimed)
+			return nil, err
+		}
+		claimed = append(claimed, name)
+	}
+	return claimed, nil
+}
+
+func (g Gcs) takeOverUnique(t server.Type, id string, field string, value string) error {
+	name := uniqueName(t, field, value)
+	owner, generation, err := g.readMarker(name)
+	if err != nil {
+		return fmt.Errorf("gcs provider failed to read unique marker %s error: %w", name, err)
+	}
+	if owner == id {
+		return nil
+	}
+
+	ownerObj, err := g.Get(t, owner)
+	if err != nil && !errors.Is(err, server.ErrNotFound) {
+		return fmt.Errorf("gcs provider failed to check unique marker %s error: %w", name, err)
+	}
+	if current, ok := server.IndexValue(ownerObj[field]); err == nil && ok && current == value {
+		return fmt.Errorf("%w: %s %s already has %s %s", server.ErrConflict, t.Name, owner, field, value)
+	}
+
+	err = g.writeIf(name, []byte(id), storage.Conditions{GenerationMatch: generation})
+	if isPreconditionFailed(err) {
+		return fmt.Errorf("%w: %s %s was claimed concurrently", server.ErrConflict, field, value)
+	}
+	return err
+}
+
+// releaseUnique removes unique markers, leaving any that have since been claimed by another object.
+func (g Gcs) releaseUnique(id string, markers []string) {
+	for _, name := range markers {
+		owner, generation, err := g.readMarker(name)
+		if err != nil || owner != id {
+			continue
+		}
+		err = g.Client.Bucket(g.Bucket).Object(name).If(storage.Conditions{GenerationMatch: generation}).Delete(context.TODO())
+		if err != nil {
+			log.Printf("gcs provider failed to release unique marker %s: %s \n", name, err)
+		}
+	}
+}
+
+func (g Gcs) readMarker(name string) (string, int64, error) {
+	reader, err := g.Client.Bucket(g.Bucket).Object(name).NewReader(context.TODO())
+	if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(content), reader.Attrs.Generation, nil
+}
+
+// KeepsHistory reports whether the bucket has object versioning enabled, versions are only kept when it does.
+func (g Gcs) KeepsHistory() bool {
+	return g.Versioned
+}
+
+// History lists the generations of an object, including the noncurrent ones kept by bucket versioning.
+func (g Gcs) History(t server.Type, id string) ([]server.Version, error) {
+	objectName := fmt.Sprintf("%s/%s", t.Name, id)
+	it := g.Client.Bucket(g.Bucket).Objects(context.TODO(), &storage.Query{Prefix: objectName, Versions: true})
+	generations := make([]*storage.ObjectAttrs, 0)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gcs provider failed to list history of %s error: %w", objectName, err)
+		}
+		if attrs.Name == objectName {
+			generations = append(generations, attrs)
+		}
+	}
+	if len(generations) == 0 {
+		return nil, fmt.Errorf("gcs provider found no history of %s error: %w", objectName, server.ErrNotFound)
+	}
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].Generation < generations[j].Generation
+	})
+
+	versions := make([]server.Version, 0, len(generations))
+	for _, attrs := range generations {
+		versions = append(versions, server.Version{Version: strconv.FormatInt(attrs.Generation, 10), Time: attrs.Created})
+	}
+	return versions, nil
+}
+
+func (g Gcs) Version(t server.Type, id string, version string) (server.Object, error) {
+	objectName := fmt.Sprintf("%s/%s", t.Name, id)
+	generation, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("gcs provider failed to find version %s of %s error: %w", version, objectName, server.ErrNotFound)
+	}
+	reader, err := g.Client.Bucket(g.Bucket).Object(objectName).Generation(generation).NewReader(context.TODO())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("gcs provider failed to find version %s of %s error: %w", version, objectName, server.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gcs provider failed to find version %s of %s error: %w", version, objectName, err)
+	}
+	defer reader.Close()
+	bytes, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("gcs provider failed to read version %s of %s error: %w", version, objectName, err)
+	}
+	data := server.Object{}
+	err = json.Unmarshal(bytes, &data)
+	if err != nil {
+		return nil, fmt.Errorf("gcs provider failed to unmarshal version %s of %s error: %w", version, objectName, err)
+	}
+	return data, nil
+}
+
+// Forget deletes every generation of an object, the noncurrent ones too.
+func (g Gcs) Forget(t server.Type, id string) error {
+	objectName := fmt.Sprintf("%s/%s", t.Name, id)
+	it := g.Client.Bucket(g.Bucket).Objects(context.TODO(), &storage.Query{Prefix: objectName, Versions: true})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("gcs provider failed to list history of %s error: %w", objectName, err)
+		}
+		if attrs.Name != objectName {
+			continue
+		}
+		err = g.Client.Bucket(g.Bucket).Object(objectName).Generation(attrs.Generation).Delete(context.TODO())
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("gcs provider failed to delete version %d of %s error: %w", attrs.Generation, objectName, err)
+		}
+	}
+}
+
+// gcsLease is the content of a _leases object.
+type gcsLease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// Lease keeps the holder of each lease in a _leases object, written with a generation precondition so only one of
+// the instances racing for an expired lease gets it.
+func (g Gcs) Lease(name string, holder string, ttl time.Duration) (bool, error) {
+	objectName := fmt.Sprintf("_leases/%s", name)
+	conditions := storage.Conditions{DoesNotExist: true}
+	content, generation, err := g.readMarker(objectName)
+	switch {
+	case err == nil:
+		var current gcsLease
+		err = json.Unmarshal([]byte(content), &current)
+		if err != nil {
+			return false, fmt.Errorf("gcs provider failed to read lease %s error: %w", name, err)
+		}
+		if current.Holder != holder && time.Now().Before(current.Expires) {
+			return false, nil
+		}
+		conditions = storage.Conditions{GenerationMatch: generation}
+	case !errors.Is(err, storage.ErrObjectNotExist):
+		return false, fmt.Errorf("gcs provider failed to read lease %s error: %w", name, err)
+	}
+
+	data, err := json.Marshal(gcsLease{Holder: holder, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return false, err
+	}
+	err = g.writeIf(objectName, data, conditions)
+	if isPreconditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("gcs provider failed to write lease %s error: %w", name, err)
+	}
+	return true, nil
+}
+
+// Reindex deletes the index and unique markers of the type and writes them again from the stored objects.
+func (g Gcs) Reindex(t server.Type) error {
+	for _, prefix := range []string{fmt.Sprintf("%s/_index/", t.Name), fmt.Sprintf("%s/_unique/", t.Name)} {
+		markers := g.Client.Bucket(g.Bucket).Objects(context.TODO(), &storage.Query{Prefix: prefix})
+		for {
+			next, err := markers.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("gcs provider failed to list markers %s error: %w", prefix, err)
+			}
+			err = g.Client.Bucket(g.Bucket).Object(next.Name).Delete(context.TODO())
+			if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+				return fmt.Errorf("gcs provider failed to delete marker %s error: %w", next.Name, err)
+			}
+		}
+	}
+
+	ids, err := g.ids(t)
+	if err != nil {
+		return err
+	}
+	var conflict error
+	for _, id := range ids {
+		obj, err := g.Get(t, id)
+		if err != nil {
+			return err
+		}
+		_, err = g.claimUnique(t, id, nil, obj)
+		if errors.Is(err, server.ErrConflict) {
+			if conflict == nil {
+				conflict = err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		added, _ := indexChanges(t, id, nil, obj)
+		for _, marker := range added {
+			err = g.write(marker, []byte{})
+			if err != nil {
+				return fmt.Errorf("gcs provider failed to index id %s error: %w", id, err)
+			}
+		}
+	}
+	return conflict
+}
+
+// previous loads the stored version of an object when its indexes need updating.
+func (g Gcs) previous(t server.Type, id string) (server.Object, error) {
+	if len(t.IndexedFields()) == 0 {
+		return nil, nil
+	}
+	old, err := g.Get(t, id)
+	if errors.Is(err, server.ErrNotFound) {
+		return nil, nil
+	}
+	return old, err
+}
+
+func (g Gcs) write(name string, data []byte) error {
+	return g.writeIf(name, data, storage.Conditions{})
+}
+
+func (g Gcs) writeIf(name string, data []byte, conditions storage.Conditions) error {
+	object := g.Client.Bucket(g.Bucket).Object(name)
+	if conditions != (storage.Conditions{}) {
+		object = object.If(conditions)
+	}
+	writer := object.NewWriter(context.TODO())
+	_, err := writer.Write(data)
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+func (g Gcs) deleteMarkers(id string, markers []string) error {
+	for _, marker := range markers {
+		err := g.Client.Bucket(g.Bucket).Object(marker).Delete(context.TODO())
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("gcs provider failed to remove index of id %s error: %w", id, err)
+		}
+	}
 	return nil
 }
+
+// indexChanges lists the index markers to add and remove when an object changes from old to new.
+func indexChanges(t server.Type, id string, old, new server.Object) ([]string, []string) {
+	added := make([]string, 0)
+	removed := make([]string, 0)
+	for _, field := range t.IndexedFields() {
+		oldValue, hadOld := server.IndexValue(old[field])
+		newValue, hasNew := server.IndexValue(new[field])
+		if hadOld && hasNew && oldValue == newValue {
+			continue
+		}
+		if hasNew {
+			added = append(added, indexPrefix(t, field, newValue)+url.PathEscape(id))
+		}
+		if hadOld {
+			removed = append(removed, indexPrefix(t, field, oldValue)+url.PathEscape(id))
+		}
+	}
+	return added, removed
+}
+
+// uniqueChanges lists the unique markers old held that new no longer does.
+func uniqueChanges(t server.Type, old, new server.Object) []string {
+	released := make([]string, 0)
+	for _, field := range t.Unique {
+		oldValue, hadOld := server.IndexValue(old[field])
+		newValue, hasNew := server.IndexValue(new[field])
+		if hadOld && (!hasNew || oldValue != newValue) {
+			released = append(released, uniqueName(t, field, oldValue))
+		}
+	}
+	return released
+}
+
+func uniqueName(t server.Type, field string, value string) string {
+	return fmt.Sprintf("%s/_unique/%s/%s", t.Name, field, url.PathEscape(value))
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+func indexPrefix(t server.Type, field string, value string) string {
+	return fmt.Sprintf("%s/_index/%s/%s/", t.Name, field, url.PathEscape(value))
+}
@@ -1,6 +1,11 @@
 package datastore_test
 
 import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
 )
 
@@ -9,3 +14,37 @@ func Test_get(t *testing.T) {
 	//server := fakestorage.NewServer([]fakestorage.Object{})
 
 }
+
+// startFakeGcs serves a fake of the bucket on a free port and returns a store using it.
+func startFakeGcs(t *testing.T, versioned bool, objects ...fakestorage.Object) datastore.Gcs {
+	// without a port in the public host the fake serves downloads on any port, see:
+	// https://github.com/fsouza/fake-gcs-server/issues/201
+	s, err := fakestorage.NewServerWithOptions(fakestorage.Options{PublicHost: "127.0.0.1"})
+	require.NoError(t, err)
+	t.Cleanup(s.Stop)
+	s.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: "cms-test-bucket", VersioningEnabled: versioned})
+	for _, obj := range objects {
+		s.CreateObject(obj)
+	}
+
+	url := s.URL() + "/storage/v1/"
+	store, err := datastore.NewGcs(datastore.GcsConfig{
+		LocalTestUrl: &url,
+		Bucket:       "cms-test-bucket",
+	})
+	require.NoError(t, err)
+	return store
+}
+
+func Test_GcsTakesOverStaleUniqueMarkers(t *testing.T) {
+	store := startFakeGcs(t, false, fakestorage.Object{
+		ObjectAttrs: fakestorage.ObjectAttrs{BucketName: "cms-test-bucket", Name: "accounts/_unique/email/a@example.com"},
+		Content:     []byte("deleted-account"),
+	})
+
+	accountsType := server.Type{Name: "accounts", Id: "id", Unique: []string{"email"}, Schema: `{"type": "object"}`}
+	require.NoError(t, store.Create(accountsType, "a", server.Object{"id": "a", "email": "a@example.com"}))
+
+	err := store.Create(accountsType, "b", server.Object{"id": "b", "email": "a@example.com"})
+	assert.ErrorIs(t, err, server.ErrConflict)
+}
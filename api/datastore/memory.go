@@ -4,12 +4,43 @@ import (
 	"crswty.com/cms/server"
 	"fmt"
 	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// Memory keeps objects in maps, for tests and local development. It must be made with NewMemory, copies share the
+// objects of the store they were copied from.
 type Memory struct {
-	Data map[string]map[string]server.Object
+	data    map[string]map[string]server.Object
+	lock    *sync.RWMutex
+	indexes map[string]map[string]index
+	leases  map[string]lease
+	history map[string]map[string]*versions
 }
 
+// maxMemoryVersions is how many versions of each object are kept, older ones are dropped.
+const maxMemoryVersions = 100
+
+// versions are the latest versions of an object, first is the number of the oldest one kept.
+type versions struct {
+	first int
+	kept  []version
+}
+
+type version struct {
+	obj     server.Object
+	written time.Time
+}
+
+type lease struct {
+	holder  string
+	expires time.Time
+}
+
+// index maps each indexed value of a field to the ids of the objects holding it.
+type index map[string]map[string]bool
+
 type Record struct {
 	Id   string
 	Type server.Type
@@ -17,7 +48,13 @@ type Record struct {
 }
 
 func NewMemory(records ...Record) (Memory, error) {
-	memory := Memory{Data: map[string]map[string]server.Object{}}
+	memory := Memory{
+		data:    map[string]map[string]server.Object{},
+		lock:    &sync.RWMutex{},
+		indexes: map[string]map[string]index{},
+		leases:  map[string]lease{},
+		history: map[string]map[string]*versions{},
+	}
 
 	for _, record := range records {
 		err := memory.Create(record.Type, record.Id, record.Data)
@@ -30,46 +67,261 @@ func NewMemory(records ...Record) (Memory, error) {
 }
 
 func (m Memory) List(t server.Type) ([]server.Object, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
 	keys := make([]string, 0)
-	for k, _ := range m.Data[t.Name] {
+	for k, _ := range m.data[t.Name] {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
 
 	objs := make([]server.Object, 0)
 	for _, key := range keys {
-		objs = append(objs, m.Data[t.Name][key])
+		objs = append(objs, m.data[t.Name][key])
 	}
 
 	return objs, nil
 }
 
 func (m Memory) Get(t server.Type, id string) (server.Object, error) {
-	allOfType, typeFound := m.Data[t.Name]
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	allOfType, typeFound := m.data[t.Name]
 	if !typeFound {
-		return server.Object{}, fmt.Errorf("no type with name %s found in storage", t.Name)
+		return server.Object{}, fmt.Errorf("no type with name %s found in storage: %w", t.Name, server.ErrNotFound)
 	}
 	obj, objectFound := allOfType[id]
 	if !objectFound {
-		return server.Object{}, fmt.Errorf("no object with id %s found in storage", id)
+		return server.Object{}, fmt.Errorf("no object with id %s found in storage: %w", id, server.ErrNotFound)
 	}
 	return obj, nil
 }
 
+func (m Memory) GetMany(t server.Type, ids []string) (map[string]server.Object, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	found := map[string]server.Object{}
+	for _, id := range ids {
+		if obj, ok := m.data[t.Name][id]; ok {
+			found[id] = obj
+		}
+	}
+	return found, nil
+}
+
+func (m Memory) Find(t server.Type, field string, value string) ([]server.Object, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ids := make([]string, 0)
+	for id := range m.indexes[t.Name][field][value] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	objs := make([]server.Object, 0)
+	for _, id := range ids {
+		objs = append(objs, m.data[t.Name][id])
+	}
+	return objs, nil
+}
+
 func (m Memory) Create(t server.Type, id string, obj server.Object) error {
-	_, typeFound := m.Data[t.Name]
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, typeFound := m.data[t.Name]
 	if !typeFound {
-		m.Data[t.Name] = map[string]server.Object{}
+		m.data[t.Name] = map[string]server.Object{}
 	}
-	m.Data[t.Name][id] = obj
+	err := m.checkUnique(t, id, obj)
+	if err != nil {
+		return err
+	}
+	m.unindex(t, id)
+	m.data[t.Name][id] = obj
+	m.index(t, id)
+	m.keep(t, id, obj)
 	return nil
 }
 
+// keep adds a version of a content object to its history, the server's own records aren't versioned.
+func (m Memory) keep(t server.Type, id string, obj server.Object) {
+	if t.Internal() {
+		return
+	}
+	if m.history[t.Name] == nil {
+		m.history[t.Name] = map[string]*versions{}
+	}
+	vs := m.history[t.Name][id]
+	if vs == nil {
+		vs = &versions{first: 1}
+		m.history[t.Name][id] = vs
+	}
+	vs.kept = append(vs.kept, version{obj: obj, written: time.Now().UTC()})
+	if len(vs.kept) > maxMemoryVersions {
+		vs.first += len(vs.kept) - maxMemoryVersions
+		vs.kept = vs.kept[len(vs.kept)-maxMemoryVersions:]
+	}
+}
+
 func (m Memory) Update(t server.Type, id string, obj server.Object) error {
 	return m.Create(t, id, obj)
 }
 
 func (m Memory) Delete(t server.Type, id string) error {
-	delete(m.Data[t.Name], id)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.unindex(t, id)
+	delete(m.data[t.Name], id)
 	return nil
 }
+
+func (m Memory) Reindex(t server.Type) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.indexes, t.Name)
+	ids := make([]string, 0)
+	for id := range m.data[t.Name] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var conflict error
+	for _, id := range ids {
+		err := m.checkUnique(t, id, m.data[t.Name][id])
+		if err != nil && conflict == nil {
+			conflict = err
+		}
+		m.index(t, id)
+	}
+	return conflict
+}
+
+// Aggregate computes the aggregation over the stored objects under the read lock, without copying the type.
+func (m Memory) Aggregate(t server.Type, q server.AggregateQuery) ([]server.AggregateRow, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	matching := make([]server.Object, 0)
+	for _, obj := range m.data[t.Name] {
+		if q.Matches(obj) {
+			matching = append(matching, obj)
+		}
+	}
+	return server.Aggregate(matching, q), nil
+}
+
+// checkUnique uses the index of each unique field, which is kept up to date under the same lock as the data.
+func (m Memory) checkUnique(t server.Type, id string, obj server.Object) error {
+	for _, field := range t.Unique {
+		value, ok := server.IndexValue(obj[field])
+		if !ok {
+			continue
+		}
+		for existing := range m.indexes[t.Name][field][value] {
+			if existing != id {
+				return fmt.Errorf("%w: %s %s already has %s %s", server.ErrConflict, t.Name, existing, field, value)
+			}
+		}
+	}
+	return nil
+}
+
+func (m Memory) index(t server.Type, id string) {
+	obj := m.data[t.Name][id]
+	for _, field := range t.IndexedFields() {
+		value, ok := server.IndexValue(obj[field])
+		if !ok {
+			continue
+		}
+		if m.indexes[t.Name] == nil {
+			m.indexes[t.Name] = map[string]index{}
+		}
+		if m.indexes[t.Name][field] == nil {
+			m.indexes[t.Name][field] = index{}
+		}
+		if m.indexes[t.Name][field][value] == nil {
+			m.indexes[t.Name][field][value] = map[string]bool{}
+		}
+		m.indexes[t.Name][field][value][id] = true
+	}
+}
+
+func (m Memory) unindex(t server.Type, id string) {
+	obj, found := m.data[t.Name][id]
+	if !found {
+		return
+	}
+	for _, field := range t.IndexedFields() {
+		value, ok := server.IndexValue(obj[field])
+		if !ok {
+			continue
+		}
+		delete(m.indexes[t.Name][field][value], id)
+		if len(m.indexes[t.Name][field][value]) == 0 {
+			delete(m.indexes[t.Name][field], value)
+		}
+	}
+}
+
+func (m Memory) Lease(name string, holder string, ttl time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	current, found := m.leases[name]
+	if found && current.holder != holder && time.Now().Before(current.expires) {
+		return false, nil
+	}
+	m.leases[name] = lease{holder: holder, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (m Memory) KeepsHistory() bool {
+	return true
+}
+
+func (m Memory) Forget(t server.Type, id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.history[t.Name], id)
+	return nil
+}
+
+// History numbers the versions of an object from 1, the latest maxMemoryVersions are kept, also after it is deleted.
+func (m Memory) History(t server.Type, id string) ([]server.Version, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	vs := m.history[t.Name][id]
+	if vs == nil || len(vs.kept) == 0 {
+		return nil, fmt.Errorf("no history of %s %s in storage: %w", t.Name, id, server.ErrNotFound)
+	}
+	history := make([]server.Version, 0, len(vs.kept))
+	for i, v := range vs.kept {
+		history = append(history, server.Version{Version: strconv.Itoa(vs.first + i), Time: v.written})
+	}
+	return history, nil
+}
+
+func (m Memory) Version(t server.Type, id string, version string) (server.Object, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	vs := m.history[t.Name][id]
+	i, err := strconv.Atoi(version)
+	if err != nil || vs == nil || i < vs.first || i >= vs.first+len(vs.kept) {
+		return nil, fmt.Errorf("no version %s of %s %s in storage: %w", version, t.Name, id, server.ErrNotFound)
+	}
+	obj := server.Object{}
+	for k, v := range vs.kept[i-vs.first].obj {
+		obj[k] = v
+	}
+	return obj, nil
+}
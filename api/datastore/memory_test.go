@@ -3,10 +3,10 @@ package datastore_test
 import (
 	"crswty.com/cms/datastore"
 	"crswty.com/cms/server"
-	"github.com/fsouza/fake-gcs-server/fakestorage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func Test_MemoryStoreFulfilsContract(t *testing.T) {
@@ -15,26 +15,32 @@ func Test_MemoryStoreFulfilsContract(t *testing.T) {
 	Contract(t, memory)
 }
 
-func Test_GcsStoreFulfilsContract(t *testing.T) {
-	s, err := fakestorage.NewServerWithOptions(fakestorage.Options{
-		Port:       8081,
-		PublicHost: "localhost:8081", // see: https://github.com/fsouza/fake-gcs-server/issues/201
-	})
+func Test_MemoryKeepsBoundedHistoryOfContent(t *testing.T) {
+	memory, err := datastore.NewMemory()
 	require.NoError(t, err)
 
-	s.CreateBucketWithOpts(fakestorage.CreateBucketOpts{
-		Name:              "cms-test-bucket",
-		VersioningEnabled: true,
-	})
+	outboxType := server.Type{Name: "_outbox", Id: "id", Schema: `{"type": "object"}`}
+	require.NoError(t, memory.Create(outboxType, "1", server.Object{"id": "1"}))
+	_, err = memory.History(outboxType, "1")
+	assert.ErrorIs(t, err, server.ErrNotFound)
 
-	url := "localhost:8081"
-	store, err := datastore.NewGcs(datastore.GcsConfig{
-		LocalTestUrl: &url,
-		Bucket:       "cms-test-bucket",
-	})
+	draftType := server.Type{Name: "notes/_draft", Id: "id", Schema: `{"type": "object"}`}
+	for i := 0; i < 105; i++ {
+		require.NoError(t, memory.Update(draftType, "1", server.Object{"id": "1", "n": i}))
+	}
+	versions, err := memory.History(draftType, "1")
+	require.NoError(t, err)
+	require.Len(t, versions, 100)
+	assert.Equal(t, "6", versions[0].Version)
+	oldest, err := memory.Version(draftType, "1", "6")
 	require.NoError(t, err)
+	assert.Equal(t, 5, oldest["n"])
+	_, err = memory.Version(draftType, "1", "5")
+	assert.ErrorIs(t, err, server.ErrNotFound)
+}
 
-	Contract(t, store)
+func Test_GcsStoreFulfilsContract(t *testing.T) {
+	Contract(t, startFakeGcs(t, true))
 }
 
 func Contract(t *testing.T, provider server.DataProvider) {
@@ -64,6 +70,20 @@ func Contract(t *testing.T, provider server.DataProvider) {
 	"properties": { "id": { "type": "string" } }
 }`}
 
+	toysType := server.Type{Name: "toys", Id: "id", Schema:
+	// language=json
+	`{
+	"type": "object",
+	"properties": { "id": { "type": "string" }, "owner": { "type": "string", "x-ref": "users" } }
+}`}
+
+	accountsType := server.Type{Name: "accounts", Id: "id", Unique: []string{"email"}, Schema:
+	// language=json
+	`{
+	"type": "object",
+	"properties": { "id": { "type": "string" }, "email": { "type": "string" } }
+}`}
+
 	user1 := server.Object{"id": "1", "name": "value1"}
 	user2 := server.Object{"id": "2", "name": "value2"}
 	user3 := server.Object{"id": "3", "name": "value3"}
@@ -94,6 +114,21 @@ func Contract(t *testing.T, provider server.DataProvider) {
 		assert.Equal(t, user2, obj)
 	})
 
+	t.Run("get many", func(t *testing.T) {
+		batch, ok := provider.(server.BatchGetter)
+		if !ok {
+			t.Skip("provider doesn't support batched gets")
+		}
+		found, err := batch.GetMany(usersType, []string{"1", "3", "missing"})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]server.Object{"1": user1, "3": user3}, found)
+	})
+
+	t.Run("get missing", func(t *testing.T) {
+		_, err := provider.Get(usersType, "missing")
+		assert.ErrorIs(t, err, server.ErrNotFound)
+	})
+
 	t.Run("update", func(t *testing.T) {
 		err := provider.Update(usersType, "2", server.Object{"id": 2, "name": "updatedValue2"})
 		require.NoError(t, err)
@@ -113,4 +148,145 @@ func Contract(t *testing.T, provider server.DataProvider) {
 		assert.Contains(t, list, user1)
 		assert.Contains(t, list, user3)
 	})
+
+	t.Run("find", func(t *testing.T) {
+		finder, ok := provider.(server.Finder)
+		if !ok {
+			t.Skip("provider doesn't support finding by indexed fields")
+		}
+
+		ball := server.Object{"id": "ball", "owner": "1"}
+		bone := server.Object{"id": "bone", "owner": "1"}
+		rope := server.Object{"id": "rope", "owner": "3"}
+		require.NoError(t, provider.Create(toysType, "ball", ball))
+		require.NoError(t, provider.Create(toysType, "bone", bone))
+		require.NoError(t, provider.Create(toysType, "rope", rope))
+
+		found, err := finder.Find(toysType, "owner", "1")
+		require.NoError(t, err)
+		assert.Equal(t, []server.Object{ball, bone}, found)
+
+		movedBone := server.Object{"id": "bone", "owner": "3"}
+		require.NoError(t, provider.Update(toysType, "bone", movedBone))
+		require.NoError(t, provider.Delete(toysType, "rope"))
+
+		found, err = finder.Find(toysType, "owner", "1")
+		require.NoError(t, err)
+		assert.Equal(t, []server.Object{ball}, found)
+
+		found, err = finder.Find(toysType, "owner", "3")
+		require.NoError(t, err)
+		assert.Equal(t, []server.Object{movedBone}, found)
+
+		list, err := provider.List(toysType)
+		require.NoError(t, err)
+		assert.Len(t, list, 2)
+	})
+
+	t.Run("unique", func(t *testing.T) {
+		require.NoError(t, provider.Create(accountsType, "a", server.Object{"id": "a", "email": "a@example.com"}))
+		require.NoError(t, provider.Create(accountsType, "b", server.Object{"id": "b", "email": "b@example.com"}))
+
+		err := provider.Create(accountsType, "c", server.Object{"id": "c", "email": "a@example.com"})
+		assert.ErrorIs(t, err, server.ErrConflict)
+		_, err = provider.Get(accountsType, "c")
+		assert.ErrorIs(t, err, server.ErrNotFound)
+
+		err = provider.Update(accountsType, "b", server.Object{"id": "b", "email": "a@example.com"})
+		assert.ErrorIs(t, err, server.ErrConflict)
+
+		assert.NoError(t, provider.Update(accountsType, "a", server.Object{"id": "a", "email": "a@example.com", "name": "same email"}))
+		assert.NoError(t, provider.Update(accountsType, "a", server.Object{"id": "a", "email": "new@example.com"}))
+		assert.NoError(t, provider.Create(accountsType, "c", server.Object{"id": "c", "email": "a@example.com"}))
+
+		assert.NoError(t, provider.Delete(accountsType, "b"))
+		assert.NoError(t, provider.Update(accountsType, "c", server.Object{"id": "c", "email": "b@example.com"}))
+	})
+
+	t.Run("reindex", func(t *testing.T) {
+		reindexer, ok := provider.(server.Reindexer)
+		if !ok {
+			t.Skip("provider doesn't keep indexes")
+		}
+
+		gamesType := server.Type{Name: "games", Id: "id", Schema: `{"type": "object"}`}
+		chess := server.Object{"id": "chess", "genre": "board"}
+		require.NoError(t, provider.Create(gamesType, "chess", chess))
+		require.NoError(t, provider.Create(gamesType, "tetris", server.Object{"id": "tetris", "genre": "puzzle"}))
+
+		gamesType.Indexes = []string{"genre"}
+		require.NoError(t, reindexer.Reindex(gamesType))
+
+		found, err := provider.(server.Finder).Find(gamesType, "genre", "board")
+		require.NoError(t, err)
+		assert.Equal(t, []server.Object{chess}, found)
+	})
+	t.Run("aggregate", func(t *testing.T) {
+		aggregator, ok := provider.(server.Aggregator)
+		if !ok {
+			t.Skip("provider doesn't aggregate")
+		}
+
+		herdsType := server.Type{Name: "herds", Id: "id", Schema: `{"type": "object"}`}
+		require.NoError(t, provider.Create(herdsType, "1", server.Object{"id": "1", "species": "cow", "legs": 4.0}))
+		require.NoError(t, provider.Create(herdsType, "2", server.Object{"id": "2", "species": "cow", "legs": 3.0}))
+		require.NoError(t, provider.Create(herdsType, "3", server.Object{"id": "3", "species": "duck", "legs": 2.0}))
+
+		rows, err := aggregator.Aggregate(herdsType, server.AggregateQuery{
+			GroupBy: []string{"species"},
+			Metrics: []server.Metric{{Function: "count"}, {Function: "max", Field: "legs"}},
+			Filters: map[string][]string{"species": {"cow"}},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []server.AggregateRow{{"species": "cow", "count": 2, "max(legs)": 4.0}}, rows)
+	})
+	t.Run("lease", func(t *testing.T) {
+		leaser, ok := provider.(server.Leaser)
+		if !ok {
+			t.Skip("provider doesn't lease")
+		}
+
+		held, err := leaser.Lease("test", "a", time.Minute)
+		require.NoError(t, err)
+		assert.True(t, held)
+
+		held, err = leaser.Lease("test", "b", time.Minute)
+		require.NoError(t, err)
+		assert.False(t, held, "lease is held by a")
+
+		held, err = leaser.Lease("test", "a", time.Millisecond)
+		require.NoError(t, err)
+		assert.True(t, held, "holder renews its lease")
+
+		time.Sleep(10 * time.Millisecond)
+		held, err = leaser.Lease("test", "b", time.Minute)
+		require.NoError(t, err)
+		assert.True(t, held, "expired lease is taken over")
+	})
+	t.Run("history", func(t *testing.T) {
+		historian, ok := provider.(server.Historian)
+		if !ok || !historian.KeepsHistory() {
+			t.Skip("provider doesn't keep history")
+		}
+
+		notesType := server.Type{Name: "notes", Id: "id", Schema: `{"type": "object"}`}
+		require.NoError(t, provider.Create(notesType, "1", server.Object{"id": "1", "text": "first"}))
+		require.NoError(t, provider.Update(notesType, "1", server.Object{"id": "1", "text": "second"}))
+		require.NoError(t, provider.Delete(notesType, "1"))
+
+		versions, err := historian.History(notesType, "1")
+		require.NoError(t, err)
+		require.Len(t, versions, 2)
+		first, err := historian.Version(notesType, "1", versions[0].Version)
+		require.NoError(t, err)
+		assert.Equal(t, server.Object{"id": "1", "text": "first"}, first)
+		second, err := historian.Version(notesType, "1", versions[1].Version)
+		require.NoError(t, err)
+		assert.Equal(t, server.Object{"id": "1", "text": "second"}, second)
+
+		_, err = historian.History(notesType, "2")
+		assert.ErrorIs(t, err, server.ErrNotFound)
+		_, err = historian.Version(notesType, "1", "0")
+		assert.ErrorIs(t, err, server.ErrNotFound)
+	})
 }
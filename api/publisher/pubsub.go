@@ -0,0 +1,76 @@
+package publisher
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"crswty.com/cms/server"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// PubSub publishes events to a Google Pub/Sub topic as JSON, with the type, object id, operation and stage of the
+// event as attributes so subscriptions can filter on them.
+type PubSub struct {
+	Client *pubsub.Client
+	Topic  *pubsub.Topic
+}
+
+type PubSubConfig struct {
+	// LocalTestAddr is the address of an emulator or fake, connected to without authentication.
+	LocalTestAddr   *string
+	Project         string
+	Topic           string
+	CredentialsFile *string
+}
+
+func NewPubSub(config PubSubConfig) (PubSub, error) {
+	opts := make([]option.ClientOption, 0)
+
+	if config.LocalTestAddr != nil {
+		conn, err := grpc.Dial(*config.LocalTestAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return PubSub{}, fmt.Errorf("unable to connect to pubsub at %s %w", *config.LocalTestAddr, err)
+		}
+		opts = append(opts, option.WithGRPCConn(conn))
+	}
+
+	if config.CredentialsFile != nil {
+		opts = append(opts, option.WithCredentialsFile(*config.CredentialsFile))
+	}
+
+	client, err := pubsub.NewClient(context.TODO(), config.Project, opts...)
+	if err != nil {
+		return PubSub{}, fmt.Errorf("unable to create pubsub client %w", err)
+	}
+
+	return PubSub{
+		Client: client,
+		Topic:  client.Topic(config.Topic),
+	}, nil
+}
+
+// Publish sends the event and waits for the topic to accept it.
+func (p PubSub) Publish(ctx context.Context, e server.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("pubsub publisher failed to marshal event %d error: %w", e.Id, err)
+	}
+	attributes := map[string]string{"type": e.Type, "objectId": e.ObjectId, "operation": e.Operation}
+	if e.Stage != "" {
+		attributes["stage"] = e.Stage
+	}
+
+	_, err = p.Topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: attributes}).Get(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsub publisher failed to publish event %d to %s error: %w", e.Id, p.Topic, err)
+	}
+	return nil
+}
+
+func (p PubSub) Close() error {
+	p.Topic.Stop()
+	return p.Client.Close()
+}
@@ -0,0 +1,49 @@
+package publisher_test
+
+import (
+	"cloud.google.com/go/pubsub/pstest"
+	"context"
+	"crswty.com/cms/publisher"
+	"crswty.com/cms/server"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"testing"
+	"time"
+)
+
+func Test_PubSubPublishesEventsWithAttributes(t *testing.T) {
+	fake := pstest.NewServer()
+	defer fake.Close()
+	_, err := fake.GServer.CreateTopic(context.Background(), &pb.Topic{Name: "projects/cms-test/topics/changes"})
+	require.NoError(t, err)
+
+	p, err := publisher.NewPubSub(publisher.PubSubConfig{
+		LocalTestAddr: &fake.Addr,
+		Project:       "cms-test",
+		Topic:         "changes",
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	event := server.Event{
+		Id:        7,
+		Time:      time.Now().UTC(),
+		Type:      "pets",
+		Stage:     "draft",
+		ObjectId:  "1",
+		Operation: server.OpCreate,
+		Object:    server.Object{"id": "1", "name": "Rex"},
+	}
+	require.NoError(t, p.Publish(context.Background(), event))
+
+	messages := fake.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, map[string]string{"type": "pets", "objectId": "1", "operation": "create", "stage": "draft"}, messages[0].Attributes)
+
+	var published server.Event
+	require.NoError(t, json.Unmarshal(messages[0].Data, &published))
+	assert.Equal(t, uint64(7), published.Id)
+	assert.Equal(t, "Rex", published.Object["name"])
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Aggregator is implemented by providers that can compute aggregations themselves instead of
+// the server listing and aggregating every object.
+type Aggregator interface {
+	Aggregate(t Type, query AggregateQuery) ([]AggregateRow, error)
+}
+
+// AggregateQuery groups the objects matching Filters by the GroupBy fields and computes the Metrics for each group.
+type AggregateQuery struct {
+	GroupBy []string
+	Metrics []Metric
+	Filters map[string][]string
+}
+
+// Metric is a function over a numeric field, e.g. avg(legs). Count doesn't need a field.
+type Metric struct {
+	Function string
+	Field    string
+}
+
+func (m Metric) String() string {
+	return fmt.Sprintf("%s(%s)", m.Function, m.Field)
+}
+
+// AggregateRow is one group, holding the group by field values and each metric keyed by its name.
+type AggregateRow map[string]interface{}
+
+var metricPattern = regexp.MustCompile(`^(count|sum|avg|min|max)\(([^()]*)\)$`)
+
+// parseAggregateQuery reads ?groupBy=species&metric=avg(legs). Both parameters may be repeated or comma separated,
+// metrics other than count must be over numeric fields of the schema. Without metrics the groups are counted.
+func (s Server) parseAggregateQuery(t Type, query url.Values) (AggregateQuery, error) {
+	numeric, err := numericFields(t)
+	if err != nil {
+		return AggregateQuery{}, err
+	}
+
+	q := AggregateQuery{GroupBy: splitParams(query["groupBy"]), Metrics: make([]Metric, 0), Filters: parseFilters(query)}
+	for _, param := range splitParams(query["metric"]) {
+		if param == "count" {
+			param = "count()"
+		}
+		match := metricPattern.FindStringSubmatch(param)
+		if match == nil {
+			return AggregateQuery{}, fmt.Errorf("%w: invalid metric %s, expected count, sum, avg, min or max of a field", ErrBadRequest, param)
+		}
+		metric := Metric{Function: match[1], Field: match[2]}
+		if metric.Function != "count" && !contains(numeric, metric.Field) {
+			return AggregateQuery{}, fmt.Errorf("%w: %s is not a numeric field of %s", ErrBadRequest, metric.Field, t.Name)
+		}
+		q.Metrics = append(q.Metrics, metric)
+	}
+	if len(q.Metrics) == 0 {
+		q.Metrics = append(q.Metrics, Metric{Function: "count"})
+	}
+	return q, nil
+}
+
+func splitParams(params []string) []string {
+	values := make([]string, 0)
+	for _, param := range params {
+		for _, value := range strings.Split(param, ",") {
+			if value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// numericFields lists the top level properties the schema types as number or integer.
+func numericFields(t Type) ([]string, error) {
+	var schema struct {
+		Properties map[string]struct {
+			Type interface{} `json:"type"`
+		} `json:"properties"`
+	}
+	err := json.Unmarshal([]byte(t.Schema), &schema)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse schema for type %s: %w", t.Name, err)
+	}
+
+	fields := make([]string, 0)
+	for field, property := range schema.Properties {
+		types := make([]interface{}, 0)
+		switch pt := property.Type.(type) {
+		case string:
+			types = append(types, pt)
+		case []interface{}:
+			types = pt
+		}
+		for _, pt := range types {
+			if pt == "number" || pt == "integer" {
+				fields = append(fields, field)
+				break
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// aggregate pushes the aggregation down to the provider when it supports it, otherwise computes it over List.
+func (s Server) aggregate(t Type, q AggregateQuery) ([]AggregateRow, error) {
+	if aggregator, ok := s.DataStore.(Aggregator); ok {
+		return aggregator.Aggregate(t, q)
+	}
+
+	objs, err := s.list(t, q.Filters)
+	if err != nil {
+		return nil, err
+	}
+	return Aggregate(objs, q), nil
+}
+
+// fields lists the fields the query reads.
+func (q AggregateQuery) fields() []string {
+	fields := append(append([]string{}, q.GroupBy...), filters(q.Filters).fields()...)
+	for _, metric := range q.Metrics {
+		if metric.Field != "" {
+			fields = append(fields, metric.Field)
+		}
+	}
+	return fields
+}
+
+// Matches reports whether obj matches the filters of the query.
+func (q AggregateQuery) Matches(obj Object) bool {
+	return filters(q.Filters).matches(obj)
+}
+
+// Aggregate computes q over objs, which are expected to already match q.Filters. Groups are ordered by their
+// values, numeric values that can't be read are skipped and metrics without any values are null.
+func Aggregate(objs []Object, q AggregateQuery) []AggregateRow {
+	type group struct {
+		row    AggregateRow
+		values map[string][]float64
+		count  int
+	}
+
+	fields := make([]string, 0)
+	for _, metric := range q.Metrics {
+		if metric.Field != "" && !contains(fields, metric.Field) {
+			fields = append(fields, metric.Field)
+		}
+	}
+
+	groups := map[string]*group{}
+	keys := make([]string, 0)
+	// without groupBy every object is in the one group, which has a row even when there are none
+	if len(q.GroupBy) == 0 {
+		groups[""] = &group{row: AggregateRow{}, values: map[string][]float64{}}
+		keys = append(keys, "")
+	}
+	for _, obj := range objs {
+		keyParts := make([]string, 0, len(q.GroupBy))
+		for _, field := range q.GroupBy {
+			part, _ := json.Marshal(obj[field])
+			keyParts = append(keyParts, string(part))
+		}
+		key := strings.Join(keyParts, "\x00")
+
+		g, found := groups[key]
+		if !found {
+			g = &group{row: AggregateRow{}, values: map[string][]float64{}}
+			for _, field := range q.GroupBy {
+				g.row[field] = obj[field]
+			}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.count++
+		for _, field := range fields {
+			if value, ok := number(obj[field]); ok {
+				g.values[field] = append(g.values[field], value)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	rows := make([]AggregateRow, 0, len(keys))
+	for _, key := range keys {
+		g := groups[key]
+		for _, metric := range q.Metrics {
+			g.row[metricName(metric)] = compute(metric, g.count, g.values[metric.Field])
+		}
+		rows = append(rows, g.row)
+	}
+	return rows
+}
+
+func metricName(m Metric) string {
+	if m.Function == "count" && m.Field == "" {
+		return "count"
+	}
+	return m.String()
+}
+
+func compute(metric Metric, count int, values []float64) interface{} {
+	if metric.Function == "count" {
+		if metric.Field == "" {
+			return count
+		}
+		return len(values)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	result := values[0]
+	for _, v := range values[1:] {
+		switch metric.Function {
+		case "sum", "avg":
+			result += v
+		case "min":
+			result = math.Min(result, v)
+		case "max":
+			result = math.Max(result, v)
+		}
+	}
+	if metric.Function == "avg" {
+		return result / float64(len(values))
+	}
+	return result
+}
+
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,68 @@
+package server_test
+
+import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+var AnimalsType = server.Type{Name: "animals", Id: "id", Schema:
+// language=json
+`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"species": { "type": "string" },
+		"legs": { "type": "integer" }
+	}
+}`}
+
+func storeWithAnimals(t *testing.T) datastore.Memory {
+	store, err := datastore.NewMemory(
+		datastore.Record{Type: AnimalsType, Id: "1", Data: server.Object{"id": "1", "species": "cow", "legs": 4.0}},
+		datastore.Record{Type: AnimalsType, Id: "2", Data: server.Object{"id": "2", "species": "cow", "legs": 3.0}},
+		datastore.Record{Type: AnimalsType, Id: "3", Data: server.Object{"id": "3", "species": "duck", "legs": 2.0}},
+	)
+	require.NoError(t, err)
+	return store
+}
+
+func TestServer_AggregateGroupsObjects(t *testing.T) {
+	url, closeFn := startServer(storeWithAnimals(t), AnimalsType)
+	defer closeFn()
+
+	body := getBody(t, fmt.Sprintf("%s/animals/_aggregate?groupBy=species&metric=avg(legs)&metric=count", url), http.StatusOK)
+	assert.JSONEq(t, `[{"species": "cow", "avg(legs)": 3.5, "count": 2}, {"species": "duck", "avg(legs)": 2, "count": 1}]`, body)
+
+	body = getBody(t, fmt.Sprintf("%s/animals/_aggregate?metric=sum(legs),min(legs),max(legs)", url), http.StatusOK)
+	assert.JSONEq(t, `[{"sum(legs)": 9, "min(legs)": 2, "max(legs)": 4}]`, body)
+
+	body = getBody(t, fmt.Sprintf("%s/animals/_aggregate?species=cow", url), http.StatusOK)
+	assert.JSONEq(t, `[{"count": 2}]`, body)
+
+	body = getBody(t, fmt.Sprintf("%s/animals/_aggregate?species=horse&metric=count,sum(legs)", url), http.StatusOK)
+	assert.JSONEq(t, `[{"count": 0, "sum(legs)": null}]`, body, "counts over no objects are a row")
+	body = getBody(t, fmt.Sprintf("%s/animals/_aggregate?species=horse&groupBy=species", url), http.StatusOK)
+	assert.JSONEq(t, `[]`, body, "there are no groups of no objects")
+}
+
+func TestServer_AggregateFallsBackToList(t *testing.T) {
+	// hides the Aggregate method of the memory store
+	url := startConfiguredServer(t, struct{ server.DataProvider }{storeWithAnimals(t)}, []server.Type{AnimalsType})
+
+	body := getBody(t, fmt.Sprintf("%s/animals/_aggregate?groupBy=species&metric=max(legs)&species=cow", url), http.StatusOK)
+	assert.JSONEq(t, `[{"species": "cow", "max(legs)": 4}]`, body)
+}
+
+func TestServer_AggregateRejectsInvalidMetrics(t *testing.T) {
+	url, closeFn := startServer(storeWithAnimals(t), AnimalsType)
+	defer closeFn()
+
+	getBody(t, fmt.Sprintf("%s/animals/_aggregate?metric=avg(species)", url), http.StatusBadRequest)
+	getBody(t, fmt.Sprintf("%s/animals/_aggregate?metric=median(legs)", url), http.StatusBadRequest)
+}
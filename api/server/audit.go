@@ -0,0 +1,390 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Operations recorded in the audit log.
+const (
+	OpCreate  = "create"
+	OpUpdate  = "update"
+	OpDelete  = "delete"
+	OpPublish = "publish"
+	OpRestore = "restore"
+	OpPurge   = "purge"
+)
+
+// DefaultAuditLimit is how many entries /api/_audit returns when the request doesn't set a limit.
+const DefaultAuditLimit = 100
+
+// AuditEntry records a change made through the api, Changes holds the before and after value of each changed field.
+type AuditEntry struct {
+	Id        string            `json:"id"`
+	Time      time.Time         `json:"time"`
+	Principal string            `json:"principal,omitempty"`
+	RequestId string            `json:"requestId,omitempty"`
+	Type      string            `json:"type"`
+	ObjectId  string            `json:"objectId"`
+	Operation string            `json:"operation"`
+	Changes   map[string]Change `json:"changes,omitempty"`
+}
+
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditSink stores audit entries.
+type AuditSink interface {
+	Record(entry AuditEntry) error
+}
+
+// AuditReader is implemented by sinks that can be queried, which /api/_audit needs.
+type AuditReader interface {
+	// Entries lists the entries matching the query, newest first.
+	Entries(q AuditQuery) ([]AuditEntry, error)
+}
+
+// AuditQuery selects audit entries, empty fields match every entry.
+type AuditQuery struct {
+	Types     []string
+	ObjectId  string
+	Principal string
+	Operation string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (q AuditQuery) matches(entry AuditEntry) bool {
+	return (q.Types == nil || contains(q.Types, entry.Type)) &&
+		(q.ObjectId == "" || q.ObjectId == entry.ObjectId) &&
+		(q.Principal == "" || q.Principal == entry.Principal) &&
+		(q.Operation == "" || q.Operation == entry.Operation) &&
+		(q.Since.IsZero() || !entry.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || entry.Time.Before(q.Until))
+}
+
+// selectEntries filters entries by the query, newest first, up to its limit.
+func selectEntries(entries []AuditEntry, q AuditQuery) []AuditEntry {
+	selected := make([]AuditEntry, 0)
+	for _, entry := range entries {
+		if q.matches(entry) {
+			selected = append(selected, entry)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].Time.After(selected[j].Time)
+	})
+	if q.Limit > 0 && len(selected) > q.Limit {
+		selected = selected[:q.Limit]
+	}
+	return selected
+}
+
+// StoreAuditSink keeps audit entries as objects of an _audit type in a provider, usually the one holding the data.
+// Entries are indexed by type and by day, so queries read only the entries of the days or types they select.
+type StoreAuditSink struct {
+	DataStore DataProvider
+}
+
+var auditType = Type{Name: "_audit", Id: "id", Indexes: []string{"type", "day"}, Schema: `{"type": "object"}`}
+
+// auditLookupDays is the longest span of days looked up day by day, queries spanning more are looked up by type.
+const auditLookupDays = 31
+
+func (a StoreAuditSink) Record(entry AuditEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	var obj Object
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		return err
+	}
+	obj["day"] = auditDay(entry.Time)
+	return a.DataStore.Create(auditType, entry.Id, obj)
+}
+
+func (a StoreAuditSink) Entries(q AuditQuery) ([]AuditEntry, error) {
+	objs, err := a.candidates(q)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AuditEntry, 0, len(objs))
+	for _, obj := range objs {
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		var entry AuditEntry
+		err = json.Unmarshal(b, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read audit entry %v: %w", obj["id"], err)
+		}
+		entries = append(entries, entry)
+	}
+	return selectEntries(entries, q), nil
+}
+
+// candidates reads the entries that can match the query. Providers keeping indexes look them up by the days the
+// query spans, or else by its types, every entry is read otherwise.
+func (a StoreAuditSink) candidates(q AuditQuery) ([]Object, error) {
+	finder, ok := a.DataStore.(Finder)
+	if !ok {
+		return a.DataStore.List(auditType)
+	}
+	field, values := "day", auditDays(q.Since, q.Until)
+	if values == nil {
+		field, values = "type", q.Types
+	}
+	if values == nil {
+		return a.DataStore.List(auditType)
+	}
+
+	objs := make([]Object, 0)
+	for _, value := range values {
+		found, err := finder.Find(auditType, field, value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find audit entries with %s %s: %w", field, value, err)
+		}
+		objs = append(objs, found...)
+	}
+	return objs, nil
+}
+
+func auditDay(at time.Time) string {
+	return at.UTC().Format("2006-01-02")
+}
+
+// auditDays lists the days from since until until, or now when until isn't set. It is nil when since isn't set or
+// they span more than auditLookupDays.
+func auditDays(since, until time.Time) []string {
+	if since.IsZero() {
+		return nil
+	}
+	if until.IsZero() {
+		until = time.Now()
+	}
+	days := make([]string, 0)
+	for day := since.UTC().Truncate(24 * time.Hour); day.Before(until); day = day.Add(24 * time.Hour) {
+		if len(days) == auditLookupDays {
+			return nil
+		}
+		days = append(days, auditDay(day))
+	}
+	return days
+}
+
+// FileAuditSink appends audit entries to a file as JSON lines.
+type FileAuditSink struct {
+	Path string
+
+	lock *sync.Mutex
+}
+
+func NewFileAuditSink(path string) FileAuditSink {
+	return FileAuditSink{Path: path, lock: &sync.Mutex{}}
+}
+
+func (a FileAuditSink) Record(entry AuditEntry) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	file, err := os.OpenFile(a.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log %s: %w", a.Path, err)
+	}
+	defer file.Close()
+	return WriterAuditSink{Writer: file}.Record(entry)
+}
+
+func (a FileAuditSink) Entries(q AuditQuery) ([]AuditEntry, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	file, err := os.Open(a.Path)
+	if os.IsNotExist(err) {
+		return []AuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log %s: %w", a.Path, err)
+	}
+	defer file.Close()
+
+	entries := make([]AuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read audit log %s: %w", a.Path, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read audit log %s: %w", a.Path, err)
+	}
+	return selectEntries(entries, q), nil
+}
+
+// WriterAuditSink writes audit entries as JSON lines, e.g. to stdout for a log collector. It can't be queried.
+type WriterAuditSink struct {
+	Writer io.Writer
+}
+
+func (a WriterAuditSink) Record(entry AuditEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = a.Writer.Write(append(b, '\n'))
+	return err
+}
+
+// newSortableId returns a unique id that sorts by time, for entries stored in a provider.
+func newSortableId(at time.Time) string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return at.Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// diff lists the top level fields that differ between before and after, either may be nil.
+func diff(before, after Object) map[string]Change {
+	changes := map[string]Change{}
+	for field, value := range after {
+		if old, found := before[field]; !found || !reflect.DeepEqual(normalize(old), normalize(value)) {
+			changes[field] = Change{Before: before[field], After: value}
+		}
+	}
+	for field, value := range before {
+		if _, found := after[field]; !found {
+			changes[field] = Change{Before: value}
+		}
+	}
+	return changes
+}
+
+// normalize round trips a value through JSON, so numbers read back from a store compare equal to those sent.
+func normalize(value interface{}) interface{} {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var normalized interface{}
+	if json.Unmarshal(b, &normalized) != nil {
+		return value
+	}
+	return normalized
+}
+
+// auditBefore reads an object at the stage before it is changed, nil when auditing is off or it doesn't exist.
+func (s Server) auditBefore(t Type, id string, stage string) Object {
+	if s.Config.Audit == nil {
+		return nil
+	}
+	before, err := s.getStage(t, id, stage)
+	if err != nil {
+		return nil
+	}
+	return copyObject(before)
+}
+
+// audit records a change made by a request. The change has been made, so failing to record it is only logged.
+func (s Server) audit(ctx context.Context, t Type, id string, operation string, before, after Object) {
+	if s.Config.Audit == nil {
+		return
+	}
+	principal, _ := PrincipalFrom(ctx)
+	now := time.Now().UTC()
+	entry := AuditEntry{
+		Id:        newSortableId(now),
+		Time:      now,
+		Principal: principal.Name,
+		RequestId: middleware.GetReqID(ctx),
+		Type:      t.Name,
+		ObjectId:  id,
+		Operation: operation,
+		Changes:   diff(before, after),
+	}
+	err := s.Config.Audit.Record(entry)
+	if err != nil {
+		log.Printf("Error recording audit entry %+v: %s \n", entry, err)
+	}
+}
+
+func parseAuditQuery(query url.Values) (AuditQuery, error) {
+	q := AuditQuery{
+		ObjectId:  query.Get("objectId"),
+		Principal: query.Get("principal"),
+		Operation: query.Get("operation"),
+		Limit:     DefaultAuditLimit,
+	}
+	if types := splitParams(query["type"]); len(types) > 0 {
+		q.Types = types
+	}
+	var err error
+	for param, at := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if value := query.Get(param); value != "" {
+			*at, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				return q, fmt.Errorf("%w: invalid %s %s, expected an RFC 3339 time", ErrBadRequest, param, value)
+			}
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		q.Limit, err = strconv.Atoi(value)
+		if err != nil || q.Limit < 1 {
+			return q, fmt.Errorf("%w: invalid limit %s", ErrBadRequest, value)
+		}
+	}
+	return q, nil
+}
+
+// listAudit serves the audit entries of the types the principal administers.
+func (s Server) listAudit(writer http.ResponseWriter, request *http.Request) {
+	reader, ok := s.Config.Audit.(AuditReader)
+	if !ok {
+		handleError(writer, fmt.Errorf("%w: the audit log can't be queried, it is written by %T", ErrBadRequest, s.Config.Audit))
+		return
+	}
+	q, err := parseAuditQuery(request.URL.Query())
+	if err != nil {
+		handleError(writer, err)
+		return
+	}
+
+	administered := make([]string, 0)
+	for _, t := range s.Config.Types {
+		if s.can(request.Context(), t.Name, ScopeAdmin) == nil && (q.Types == nil || contains(q.Types, t.Name)) {
+			administered = append(administered, t.Name)
+		}
+	}
+	q.Types = administered
+
+	entries, err := reader.Entries(q)
+	if err != nil {
+		handleError(writer, err)
+		return
+	}
+	writer.Header().Set("X-Total-Count", fmt.Sprintf("%d", len(entries)))
+	writeJSON(writer, entries)
+}
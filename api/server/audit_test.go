@@ -0,0 +1,164 @@
+package server_test
+
+import (
+	"bytes"
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var auditKeys = server.AuthConfig{APIKeys: []server.APIKey{
+	{Name: "editor", Hash: server.HashKey("editor-key"), Permissions: map[string][]server.Scope{"user": {server.ScopeRead, server.ScopeWrite, server.ScopeDelete}}},
+	{Name: "auditor", Hash: server.HashKey("auditor-key"), Permissions: map[string][]server.Scope{server.AnyType: {server.ScopeRead, server.ScopeAdmin}}},
+}}
+
+func makeAuditedChanges(t *testing.T, url string) {
+	request, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/user/1", url), strings.NewReader(`{"id": "1", "name": "sam"}`))
+	require.NoError(t, err)
+	request.Header.Set("X-API-Key", "editor-key")
+	request.Header.Set("X-Request-Id", "req-1")
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "2", "name": "alex"}`, "editor-key")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/user/2", url), "", "editor-key")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func auditEntries(t *testing.T, url string, query string, key string) []server.AuditEntry {
+	resp := authRequest(t, http.MethodGet, fmt.Sprintf("%s/_audit?%s", url, query), "", key)
+	body := readBody(t, resp)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	var entries []server.AuditEntry
+	require.NoError(t, json.Unmarshal([]byte(body), &entries))
+	return entries
+}
+
+func TestServer_AuditRecordsChanges(t *testing.T) {
+	for name, sink := range map[string]server.AuditSink{
+		"store": server.StoreAuditSink{DataStore: func() server.DataProvider {
+			store, err := datastore.NewMemory()
+			require.NoError(t, err)
+			return store
+		}()},
+		"file": server.NewFileAuditSink(filepath.Join(t.TempDir(), "audit.log")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAuth(auditKeys), withAudit(sink))
+			makeAuditedChanges(t, url)
+
+			entries := auditEntries(t, url, "", "auditor-key")
+			require.Len(t, entries, 3)
+			assert.Equal(t, server.OpDelete, entries[0].Operation)
+			assert.Equal(t, server.OpCreate, entries[1].Operation)
+
+			update := entries[2]
+			assert.Equal(t, server.OpUpdate, update.Operation)
+			assert.Equal(t, "editor", update.Principal)
+			assert.Equal(t, "req-1", update.RequestId)
+			assert.Equal(t, "user", update.Type)
+			assert.Equal(t, "1", update.ObjectId)
+			assert.Equal(t, map[string]server.Change{"name": {Before: "chris", After: "sam"}}, update.Changes)
+
+			entries = auditEntries(t, url, "objectId=2&operation=delete", "auditor-key")
+			require.Len(t, entries, 1)
+			assert.Equal(t, map[string]server.Change{"id": {Before: "2"}, "name": {Before: "alex"}}, entries[0].Changes)
+
+			assert.Len(t, auditEntries(t, url, "limit=1", "auditor-key"), 1)
+			assert.Empty(t, auditEntries(t, url, "", "editor-key"), "only administered types are audited")
+			resp := authRequest(t, http.MethodGet, fmt.Sprintf("%s/_audit?since=yesterday", url), "", "auditor-key")
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+func TestServer_AuditWritesToWriter(t *testing.T) {
+	var out bytes.Buffer
+	url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAuth(auditKeys), withAudit(server.WriterAuditSink{Writer: &out}))
+	makeAuditedChanges(t, url)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	var entry server.AuditEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, server.OpUpdate, entry.Operation)
+
+	resp := authRequest(t, http.MethodGet, fmt.Sprintf("%s/_audit", url), "", "auditor-key")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServer_AuditRecordsPostsReplacingObjectsAsUpdates(t *testing.T) {
+	var out bytes.Buffer
+	url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAuth(auditKeys), withAudit(server.WriterAuditSink{Writer: &out}))
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "1", "name": "alex"}`, "editor-key")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var entry server.AuditEntry
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, server.OpUpdate, entry.Operation)
+	assert.Equal(t, map[string]server.Change{"name": {Before: "chris", After: "alex"}}, entry.Changes)
+}
+
+// auditListingStore counts how often the whole audit log is listed.
+type auditListingStore struct {
+	datastore.Memory
+	lists *int
+}
+
+func (a auditListingStore) List(t server.Type) ([]server.Object, error) {
+	if t.Name == "_audit" {
+		*a.lists++
+	}
+	return a.Memory.List(t)
+}
+
+func TestServer_AuditQueriesAreLookedUp(t *testing.T) {
+	memory, err := datastore.NewMemory()
+	require.NoError(t, err)
+	store := auditListingStore{Memory: memory, lists: new(int)}
+	url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAuth(auditKeys), withAudit(server.StoreAuditSink{DataStore: store}))
+	makeAuditedChanges(t, url)
+
+	since := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	assert.Len(t, auditEntries(t, url, "since="+since, "auditor-key"), 3)
+	assert.Len(t, auditEntries(t, url, "type=user", "auditor-key"), 3)
+	assert.Empty(t, auditEntries(t, url, "since=2020-01-01T00:00:00Z&until=2020-01-02T00:00:00Z", "auditor-key"))
+	assert.Len(t, auditEntries(t, url, "since=2020-01-01T00:00:00Z", "auditor-key"), 3, "long spans are looked up by type")
+	assert.Zero(t, *store.lists, "entries are found through the indexes")
+}
+
+func TestServer_AuditRecordsReferencesChangedByDeletes(t *testing.T) {
+	for _, onDelete := range []server.OnDelete{server.OnDeleteCascade, server.OnDeleteSetNull} {
+		t.Run(string(onDelete), func(t *testing.T) {
+			pets := petsType(onDelete)
+			sinkStore, err := datastore.NewMemory()
+			require.NoError(t, err)
+			url := startConfiguredServer(t, storeWithPet(t, pets), []server.Type{UsersType, pets}, withAudit(server.StoreAuditSink{DataStore: sinkStore}))
+
+			resp := deleteRequest(t, fmt.Sprintf("%s/users/1", url))
+			require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+			entries := auditEntries(t, url, "type=pets", "")
+			require.Len(t, entries, 1)
+			assert.Equal(t, "1", entries[0].ObjectId)
+			if onDelete == server.OnDeleteCascade {
+				assert.Equal(t, server.OpDelete, entries[0].Operation)
+				assert.Equal(t, map[string]server.Change{"id": {Before: "1"}, "owner": {Before: "1"}}, entries[0].Changes)
+			} else {
+				assert.Equal(t, server.OpUpdate, entries[0].Operation)
+				assert.Equal(t, map[string]server.Change{"owner": {Before: "1"}}, entries[0].Changes)
+			}
+			assert.Len(t, auditEntries(t, url, "type=users", ""), 1)
+		})
+	}
+}
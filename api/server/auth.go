@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scope is an operation a principal can be granted on a type.
+type Scope string
+
+const (
+	ScopeRead   Scope = "read"
+	ScopeWrite  Scope = "write"
+	ScopeDelete Scope = "delete"
+	// ScopePublish allows publishing the drafts of types with a draft workflow.
+	ScopePublish Scope = "publish"
+	// ScopeAdmin lifts the restriction of types with an owner field to the objects the principal owns.
+	ScopeAdmin Scope = "admin"
+)
+
+// AnyType grants scopes on every type when used as a permissions key.
+const AnyType = "*"
+
+var (
+	// ErrUnauthorized is returned, wrapped, when a request has no valid credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned, wrapped, when the principal isn't allowed to make a request.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// AuthConfig configures how requests are authenticated. Authentication is disabled when nothing is configured.
+type AuthConfig struct {
+	APIKeys []APIKey
+	JWT     *JWTConfig
+	// Roles grant permissions to API keys, users and token principals by name.
+	Roles map[string]Role
+	// Users log in to the admin UI, which then uses a session cookie.
+	Users []User
+	// SessionSecret signs session cookies. A random one is used when it isn't set, so sessions end on restart.
+	SessionSecret string
+	SessionTTL    time.Duration
+}
+
+// APIKey is a key accepted by the server, sent as an X-API-Key header, an "Authorization: ApiKey <key>" header or
+// as the password of basic auth.
+type APIKey struct {
+	Name string
+	// Hash is the hex encoded SHA-256 of the key, see HashKey, so the key itself isn't kept in the config.
+	Hash string
+	// Permissions are the scopes granted on each type name, or on every type with AnyType.
+	Permissions map[string][]Scope
+	// Roles grant the key further permissions, with the field rules of each role.
+	Roles []string
+}
+
+// Kinds of principal, API keys, token subjects and users are named independently of each other.
+const (
+	KindKey   = "key"
+	KindToken = "jwt"
+	KindUser  = "user"
+)
+
+// Principal is who a request is made by.
+type Principal struct {
+	Name string
+	// Kind tells what Name is the name of, see KindKey, KindToken and KindUser.
+	Kind        string
+	Roles       []string
+	Permissions map[string][]Scope
+
+	grants []Role
+}
+
+// Can reports whether the principal has been granted scope on the type.
+func (p Principal) Can(typeName string, scope Scope) bool {
+	for _, name := range []string{typeName, AnyType} {
+		for _, granted := range p.Permissions[name] {
+			if granted == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// Owner is the value the owner field of the objects the principal creates is stamped with, the name prefixed with the
+// kind, so a token subject doesn't own the objects of an API key with the same name.
+func (p Principal) Owner() string {
+	return p.Kind + ":" + p.Name
+}
+
+// internalKey marks requests the server dispatches itself.
+type internalKey struct{}
+
+// PrincipalFrom returns the principal authenticate stored in the request context, if there is one.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// HashKey returns the hash of an API key to put in the config.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s Server) authEnabled() bool {
+	return len(s.Config.Auth.APIKeys) > 0 || s.Config.Auth.JWT != nil || len(s.Config.Auth.Users) > 0
+}
+
+// authenticate rejects requests without valid credentials with a 401 and stores the principal in the context.
+func (s Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !s.authEnabled() {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		// requests dispatched by the server itself, e.g. writes sent over a WebSocket, carry the principal it has just
+		// authenticated
+		if internal, _ := request.Context().Value(internalKey{}).(bool); internal {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		principal, err := s.principal(request)
+		if err != nil {
+			// browsers would prompt for basic auth instead of using the login page
+			if errors.Is(err, ErrUnauthorized) && s.sessions == nil {
+				writer.Header().Set("WWW-Authenticate", `Basic realm="cms"`)
+			}
+			handleError(writer, err)
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), principalKey{}, principal)))
+	})
+}
+
+func (s Server) principal(request *http.Request) (Principal, error) {
+	key := request.Header.Get("X-API-Key")
+	scheme, credentials, _ := strings.Cut(request.Header.Get("Authorization"), " ")
+	switch {
+	case strings.EqualFold(scheme, "ApiKey"):
+		key = credentials
+	case strings.EqualFold(scheme, "Bearer"):
+		if s.tokens == nil {
+			return Principal{}, fmt.Errorf("%w: bearer tokens aren't accepted", ErrUnauthorized)
+		}
+		return s.tokens.principal(credentials, s.Config.Auth.Roles)
+	}
+	if _, password, ok := request.BasicAuth(); ok {
+		key = password
+	}
+	if key == "" && s.sessions != nil {
+		user, err := s.sessions.user(request)
+		if err != nil {
+			return Principal{}, err
+		}
+		return newPrincipal(KindUser, user.Name, user.Permissions, s.Config.Auth.Roles, user.Roles), nil
+	}
+	if key == "" {
+		return Principal{}, fmt.Errorf("%w: missing credentials", ErrUnauthorized)
+	}
+
+	hash := []byte(HashKey(key))
+	for _, apiKey := range s.Config.Auth.APIKeys {
+		if subtle.ConstantTimeCompare(hash, []byte(strings.ToLower(apiKey.Hash))) == 1 {
+			return newPrincipal(KindKey, apiKey.Name, apiKey.Permissions, s.Config.Auth.Roles, apiKey.Roles), nil
+		}
+	}
+	return Principal{}, fmt.Errorf("%w: invalid credentials", ErrUnauthorized)
+}
+
+// authorize rejects requests whose principal hasn't been granted scope on each of the types with a 403.
+func (s Server) authorize(scope Scope, typeNames ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			for _, typeName := range typeNames {
+				err := s.can(request.Context(), typeName, scope)
+				if err != nil {
+					handleError(writer, err)
+					return
+				}
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func (s Server) can(ctx context.Context, typeName string, scope Scope) error {
+	if !s.authEnabled() {
+		return nil
+	}
+	principal, _ := PrincipalFrom(ctx)
+	if !principal.Can(typeName, scope) {
+		return fmt.Errorf("%w: %s can't %s %s", ErrForbidden, principal.Name, scope, typeName)
+	}
+	return nil
+}
+
+// authorizeExpansion checks the principal can read every type an expansion of t embeds.
+func (s Server) authorizeExpansion(ctx context.Context, t Type, tree expansion) error {
+	for field, children := range tree {
+		relation := s.relation(t, field)
+		if relation == nil {
+			continue
+		}
+		err := s.can(ctx, relation.Type, ScopeRead)
+		if err != nil {
+			return err
+		}
+		err = s.authorizeExpansion(ctx, *typeByName(s.Config.Types, relation.Type), children)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
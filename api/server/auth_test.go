@@ -0,0 +1,79 @@
+package server_test
+
+import (
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var apiKeys = server.AuthConfig{APIKeys: []server.APIKey{
+	{Name: "reader", Hash: server.HashKey("read-key"), Permissions: map[string][]server.Scope{"user": {server.ScopeRead}}},
+	{Name: "admin", Hash: server.HashKey("admin-key"), Permissions: map[string][]server.Scope{server.AnyType: {server.ScopeRead, server.ScopeWrite, server.ScopeDelete}}},
+}}
+
+func authRequest(t *testing.T, method string, url string, body string, key string) *http.Response {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	if key != "" {
+		request.Header.Set("X-API-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestServer_RejectsRequestsWithoutValidKey(t *testing.T) {
+	url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAuth(apiKeys))
+
+	resp := authRequest(t, http.MethodGet, fmt.Sprintf("%s/user/1", url), "", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Basic realm="cms"`, resp.Header.Get("WWW-Authenticate"))
+
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/user/1", url), "", "wrong-key")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/describe", url), "", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodGet, strings.TrimSuffix(url, "/api")+"/admin/", "", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServer_EnforcesKeyScopes(t *testing.T) {
+	url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAuth(apiKeys))
+
+	resp := authRequest(t, http.MethodGet, fmt.Sprintf("%s/user/1", url), "", "read-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "2", "name": "fred"}`, "read-key")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/user/1", url), "", "read-key")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "2", "name": "fred"}`, "admin-key")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/user/1", url), "", "admin-key")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestServer_AcceptsKeyInAuthorizationHeader(t *testing.T) {
+	url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAuth(apiKeys))
+
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/user/1", url), nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "ApiKey read-key")
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	request, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/user/1", url), nil)
+	require.NoError(t, err)
+	request.SetBasicAuth("anyone", "read-key")
+	resp, err = http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"time"
+)
+
+// DefaultContentPath is where the delivery API is served when Config.ContentPath isn't set.
+const DefaultContentPath = "/content"
+
+// DefaultContentMaxAge is how long clients and CDNs may cache delivery API responses when Config.ContentMaxAge isn't set.
+const DefaultContentMaxAge = time.Minute
+
+// addContentEndpoints serves the published objects of public types read only and without authentication, for
+// websites to fetch content from. Only Type.PublicFields are served and responses are cacheable.
+func (s Server) addContentEndpoints(r chi.Router) {
+	for _, t := range s.Config.Types {
+		if !t.Public {
+			continue
+		}
+		t := t
+
+		r.Get(fmt.Sprintf("/%s", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+			f := parseFilters(request.URL.Query())
+			for _, field := range f.fields() {
+				if !t.publicField(field) {
+					handleError(writer, fmt.Errorf("%w: %s can't be filtered on", ErrBadRequest, field))
+					return
+				}
+			}
+
+			data, err := s.list(t, f)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			published := make([]Object, 0, len(data))
+			for _, obj := range data {
+				published = append(published, t.publicObject(obj))
+			}
+			s.writeContent(writer, request, published)
+		})
+
+		r.Get(fmt.Sprintf("/%s/{id}", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+			data, err := s.DataStore.Get(t, chi.URLParam(request, "id"))
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			s.writeContent(writer, request, t.publicObject(data))
+		})
+	}
+}
+
+func (t Type) publicField(field string) bool {
+	return len(t.PublicFields) == 0 || field == t.Id || contains(t.PublicFields, field)
+}
+
+func (t Type) publicObject(obj Object) Object {
+	public := Object{}
+	for field, value := range obj {
+		if t.publicField(field) {
+			public[field] = value
+		}
+	}
+	return public
+}
+
+// writeContent writes the response with caching headers, answering requests for a version the client already has
+// with a 304.
+func (s Server) writeContent(writer http.ResponseWriter, request *http.Request, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		handleError(writer, err)
+		return
+	}
+	sum := sha256.Sum256(b)
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:16]))
+
+	maxAge := s.Config.ContentMaxAge
+	if maxAge == 0 {
+		maxAge = DefaultContentMaxAge
+	}
+	writer.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d", int(maxAge.Seconds()), int(maxAge.Seconds())*10))
+	writer.Header().Set("ETag", etag)
+	if request.Header.Get("If-None-Match") == etag {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if list, ok := data.([]Object); ok {
+		writer.Header().Set("X-Total-Count", fmt.Sprintf("%d", len(list)))
+	}
+	_, err = writer.Write(b)
+	if err != nil {
+		handleError(writer, err)
+		return
+	}
+}
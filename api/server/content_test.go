@@ -0,0 +1,72 @@
+package server_test
+
+import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+var PostsType = server.Type{Name: "posts", Id: "id", Public: true, PublicFields: []string{"title"}, Schema:
+// language=json
+`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"title": { "type": "string" },
+		"notes": { "type": "string" }
+	}
+}`}
+
+var hello = datastore.Record{Type: PostsType, Id: "1", Data: server.Object{"id": "1", "title": "Hello", "notes": "internal"}}
+
+// contentURL is the content api of a server started by startConfiguredServer.
+func contentURL(url string) string {
+	return baseURL(url) + "/content"
+}
+
+func TestServer_ContentServesPublicTypesWithoutAuth(t *testing.T) {
+	url := contentURL(startConfiguredServer(t, storeWith(t, hello, chris), []server.Type{PostsType, BasicType}, withAuth(apiKeys)))
+
+	resp, err := http.Get(fmt.Sprintf("%s/posts", url))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[{"id": "1", "title": "Hello"}]`, readBody(t, resp))
+	assert.Equal(t, "public, max-age=60, stale-while-revalidate=600", resp.Header.Get("Cache-Control"))
+
+	resp, err = http.Get(fmt.Sprintf("%s/posts/1", url))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"id": "1", "title": "Hello"}`, readBody(t, resp))
+
+	resp, err = http.Get(fmt.Sprintf("%s/posts?notes=internal", url))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(fmt.Sprintf("%s/user/1", url))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/posts/1", url), "", "admin-key")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestServer_ContentAnswersConditionalRequests(t *testing.T) {
+	url := contentURL(startConfiguredServer(t, storeWith(t, hello, chris), []server.Type{PostsType, BasicType}, withAuth(apiKeys)))
+
+	resp, err := http.Get(fmt.Sprintf("%s/posts/1", url))
+	require.NoError(t, err)
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/posts/1", url), nil)
+	require.NoError(t, err)
+	request.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultEventBuffer is how many recent events are kept for clients resuming a stream, when Config.EventBuffer
+// isn't set.
+const DefaultEventBuffer = 1000
+
+// eventKeepAlive is how often a comment is sent on idle streams, so proxies don't close them.
+const eventKeepAlive = 15 * time.Second
+
+// Event is a change to an object, Object is nil for deletes. Ids increase by one with every event an instance
+// publishes.
+type Event struct {
+	Id uint64 `json:"id"`
+	// Key is the outbox entry the event was recorded as, it identifies the event across instances so consumers can
+	// drop the ones they have already handled.
+	Key       string    `json:"key,omitempty"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Stage     string    `json:"stage,omitempty"`
+	ObjectId  string    `json:"objectId"`
+	Operation string    `json:"operation"`
+	Object    Object    `json:"object,omitempty"`
+
+	// deleted is the object deleted by a delete, so events can be matched against it without sending it.
+	deleted Object
+}
+
+// eventBus hands every event published to its subscribers and keeps the most recent ones in a ring buffer, so
+// subscribers can resume from the last event they have seen.
+type eventBus struct {
+	lock        *sync.Mutex
+	recent      []Event
+	next        uint64
+	subscribers map[chan Event]bool
+}
+
+func newEventBus(size int) *eventBus {
+	if size <= 0 {
+		size = DefaultEventBuffer
+	}
+	return &eventBus{lock: &sync.Mutex{}, recent: make([]Event, 0, size), next: 1, subscribers: map[chan Event]bool{}}
+}
+
+// publish numbers the event and sends it to every subscriber, returning the numbered event. Subscribers that can't
+// keep up are dropped, closing their channel, they can resume from the buffer.
+func (b *eventBus) publish(e Event) Event {
+	if b == nil {
+		return e
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	e.Id = b.next
+	b.next++
+	if len(b.recent) == cap(b.recent) {
+		copy(b.recent, b.recent[1:])
+		b.recent = b.recent[:len(b.recent)-1]
+	}
+	b.recent = append(b.recent, e)
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- e:
+		default:
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return e
+}
+
+// subscribe returns the buffered events after the given id and a channel receiving the events published from now
+// on. complete is false when events after the id have already left the buffer, or weren't published by this bus.
+func (b *eventBus) subscribe(after uint64) (replay []Event, events chan Event, complete bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	replay = make([]Event, 0)
+	switch {
+	case after == 0:
+		complete = true
+	case after >= b.next:
+		// the id was handed out by an instance that has restarted or by another one
+		complete = false
+	default:
+		complete = len(b.recent) == 0 || b.recent[0].Id <= after+1
+		for _, e := range b.recent {
+			if e.Id > after {
+				replay = append(replay, e)
+			}
+		}
+	}
+	events = make(chan Event, 64)
+	b.subscribers[events] = true
+	return replay, events, complete
+}
+
+func (b *eventBus) unsubscribe(events chan Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.subscribers[events] {
+		delete(b.subscribers, events)
+		close(events)
+	}
+}
+
+// follow calls handle with every event published until the context is done, resuming from the last event handled
+// when it falls behind.
+func (s Server) follow(ctx context.Context, name string, handle func(e Event)) {
+	var after uint64
+	for {
+		replay, events, complete := s.events.subscribe(after)
+		if !complete {
+			log.Printf("Events since %d were missed by %s \n", after, name)
+		}
+		for _, e := range replay {
+			handle(e)
+			after = e.Id
+		}
+		for open := true; open; {
+			select {
+			case <-ctx.Done():
+				s.events.unsubscribe(events)
+				return
+			case e, ok := <-events:
+				if open = ok; ok {
+					handle(e)
+					after = e.Id
+				}
+			}
+		}
+	}
+}
+
+// event describes a change made to an object of t, which may be the draft type of a configured type. obj is the
+// object written, or the one deleted.
+func (s Server) event(t Type, id string, operation string, obj Object) Event {
+	e := Event{Time: time.Now().UTC(), Type: t.Name, ObjectId: id, Operation: operation}
+	if name := strings.TrimSuffix(t.Name, "/_draft"); name != t.Name {
+		e.Type = name
+		e.Stage = StageDraft
+	}
+	if obj != nil {
+		obj = copyObject(obj)
+	}
+	if operation == OpDelete {
+		e.deleted = obj
+	} else {
+		e.Object = obj
+	}
+	return e
+}
+
+// emit publishes an event once the change it describes has been made, committing it in the outbox first.
+func (s Server) emit(e Event) {
+	if s.events == nil {
+		return
+	}
+	e = s.events.publish(e)
+	s.commit(e)
+}
+
+// subject is the object an event is about, the deleted object for deletes when it could be read.
+func (e Event) subject() Object {
+	if e.Operation == OpDelete {
+		return e.deleted
+	}
+	return e.Object
+}
+
+// visible prepares an event for a principal, reporting false when it can't read the object changed.
+func (s Server) visible(ctx context.Context, e Event) (Event, bool) {
+	t := typeByName(s.Config.Types, e.Type)
+	if t == nil || s.can(ctx, t.Name, ScopeRead) != nil {
+		return e, false
+	}
+	if !s.owns(ctx, *t, e.subject()) {
+		return e, false
+	}
+	if e.Object != nil {
+		e.Object = copyObject(e.Object)
+		s.hide(ctx, *t, []Object{e.Object}, nil)
+	}
+	return e, true
+}
+
+// streamEvents serves the changes to objects of the given types, all readable types when none are given, as
+// server-sent events. Clients resume from the Last-Event-ID header, or lastEventId parameter, a reset event is sent
+// when events since have been missed.
+func (s Server) streamEvents(types ...string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		flusher, ok := writer.(http.Flusher)
+		if !ok {
+			handleError(writer, fmt.Errorf("streaming isn't supported"))
+			return
+		}
+		lastId := request.Header.Get("Last-Event-ID")
+		if lastId == "" {
+			lastId = request.URL.Query().Get("lastEventId")
+		}
+		var after uint64
+		if lastId != "" {
+			var err error
+			after, err = strconv.ParseUint(lastId, 10, 64)
+			if err != nil {
+				handleError(writer, fmt.Errorf("%w: invalid last event id %s", ErrBadRequest, lastId))
+				return
+			}
+		}
+
+		replay, events, complete := s.events.subscribe(after)
+		defer s.events.unsubscribe(events)
+
+		writer.Header().Set("Content-Type", "text/event-stream")
+		writer.Header().Set("Cache-Control", "no-cache")
+		writer.Header().Set("X-Accel-Buffering", "no")
+		writer.WriteHeader(http.StatusOK)
+		if !complete {
+			_, _ = fmt.Fprint(writer, "event: reset\ndata: {}\n\n")
+		}
+
+		send := func(e Event) error {
+			if len(types) > 0 && !contains(types, e.Type) {
+				return nil
+			}
+			e, ok := s.visible(request.Context(), e)
+			if !ok {
+				return nil
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Operation, b)
+			return err
+		}
+		for _, e := range replay {
+			if send(e) != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-request.Context().Done():
+				return
+			case e, open := <-events:
+				if !open || send(e) != nil {
+					return
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(writer, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
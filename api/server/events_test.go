@@ -0,0 +1,139 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseMessage struct {
+	id    string
+	event string
+	data  string
+}
+
+// openEvents connects to an event stream, returning the messages received until the test ends.
+func openEvents(t *testing.T, url string, lastEventId string, key string) <-chan sseMessage {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if lastEventId != "" {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+	if key != "" {
+		request.Header.Set("X-API-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	messages := make(chan sseMessage, 16)
+	go func() {
+		defer resp.Body.Close()
+		defer close(messages)
+		scanner := bufio.NewScanner(resp.Body)
+		message := sseMessage{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				messages <- message
+				message = sseMessage{}
+			case strings.HasPrefix(line, "id: "):
+				message.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				message.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				message.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return messages
+}
+
+func nextMessage(t *testing.T, messages <-chan sseMessage) sseMessage {
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(time.Second):
+		require.Fail(t, "no event received")
+		return sseMessage{}
+	}
+}
+
+func TestServer_StreamsEvents(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	url, closeFn := startServer(store, BasicType, DocsType)
+	t.Cleanup(closeFn)
+
+	users := openEvents(t, fmt.Sprintf("%s/user/_events", url), "", "")
+	all := openEvents(t, fmt.Sprintf("%s/_events", url), "", "")
+
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs", url), `{"id": "1", "title": "Plan"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "1", "name": "chris"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/user/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	message := nextMessage(t, users)
+	assert.Equal(t, "2", message.id)
+	assert.Equal(t, "create", message.event)
+	assert.Contains(t, message.data, `"type":"user","objectId":"1","operation":"create","object":{"id":"1","name":"chris"}`)
+	message = nextMessage(t, users)
+	assert.Equal(t, "delete", message.event)
+	assert.NotContains(t, message.data, `"object"`)
+
+	assert.Equal(t, "1", nextMessage(t, all).id)
+	assert.Equal(t, "2", nextMessage(t, all).id)
+	assert.Equal(t, "3", nextMessage(t, all).id)
+}
+
+func TestServer_ResumesEventStreams(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	url, closeFn := startServer(store, BasicType)
+	t.Cleanup(closeFn)
+
+	for _, id := range []string{"1", "2"} {
+		resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), fmt.Sprintf(`{"id": "%s", "name": "chris"}`, id), "")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	message := nextMessage(t, openEvents(t, fmt.Sprintf("%s/_events", url), "1", ""))
+	assert.Equal(t, "2", message.id)
+	assert.Contains(t, message.data, `"objectId":"2"`)
+
+	message = nextMessage(t, openEvents(t, fmt.Sprintf("%s/_events", url), "99", ""))
+	assert.Equal(t, "reset", message.event)
+}
+
+func TestServer_EventsRespectPermissions(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	url := startConfiguredServer(t, store, []server.Type{BasicType, DocsType}, withAuth(apiKeys))
+
+	resp := authRequest(t, http.MethodGet, fmt.Sprintf("%s/docs/_events", url), "", "read-key")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	messages := openEvents(t, fmt.Sprintf("%s/_events", url), "", "read-key")
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs", url), `{"id": "1", "title": "Plan"}`, "admin-key")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "1", "name": "chris"}`, "admin-key")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	message := nextMessage(t, messages)
+	assert.Equal(t, "2", message.id, "docs can't be read with the key")
+	assert.Contains(t, message.data, `"type":"user"`)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DefaultMaxExpandDepth limits how deep ?expand= paths can go when Config.MaxExpandDepth isn't set.
+const DefaultMaxExpandDepth = 3
+
+// BatchGetter is implemented by providers that can fetch several objects of a type in one call.
+// Ids that don't exist are left out of the result.
+type BatchGetter interface {
+	GetMany(t Type, ids []string) (map[string]Object, error)
+}
+
+// expansion is the tree of relations to embed, e.g. ?expand=owner,owner.company is {owner: {company: {}}}.
+type expansion map[string]expansion
+
+// parseExpansion reads the comma separated, dot nested relation paths of the expand query parameter.
+func (s Server) parseExpansion(t Type, query url.Values) (expansion, error) {
+	maxDepth := s.Config.MaxExpandDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxExpandDepth
+	}
+
+	tree := expansion{}
+	for _, param := range query["expand"] {
+		for _, path := range strings.Split(param, ",") {
+			if path == "" {
+				continue
+			}
+			fields := strings.Split(path, ".")
+			if len(fields) > maxDepth {
+				return nil, fmt.Errorf("%w: expand %s is deeper than the maximum of %d", ErrBadRequest, path, maxDepth)
+			}
+
+			node := tree
+			current := t
+			for _, field := range fields {
+				relation := s.relation(current, field)
+				if relation == nil {
+					return nil, fmt.Errorf("%w: %s has no relation %s to expand", ErrBadRequest, current.Name, field)
+				}
+				if node[field] == nil {
+					node[field] = expansion{}
+				}
+				node = node[field]
+				current = *typeByName(s.Config.Types, relation.Type)
+			}
+		}
+	}
+	return tree, nil
+}
+
+func (s Server) relation(t Type, field string) *Relation {
+	for _, r := range s.relations[t.Name] {
+		if r.Field == field {
+			return &r
+		}
+	}
+	return nil
+}
+
+// expand returns copies of objs with the relations in tree replaced by the objects they reference.
+// Each level is fetched with a single batched lookup; references to missing objects are left as ids.
+func (s Server) expand(t Type, objs []Object, tree expansion) ([]Object, error) {
+	expanded := make([]Object, 0, len(objs))
+	for _, obj := range objs {
+		expanded = append(expanded, copyObject(obj))
+	}
+	if len(tree) == 0 {
+		return expanded, nil
+	}
+
+	fields := make([]string, 0)
+	for field := range tree {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		target := *typeByName(s.Config.Types, s.relation(t, field).Type)
+
+		ids := make([]string, 0)
+		seen := map[string]bool{}
+		for _, obj := range expanded {
+			id, err := idToString(obj[field])
+			if err == nil && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+
+		found, err := s.getMany(target, ids)
+		if err != nil {
+			return nil, fmt.Errorf("unable to expand %s.%s: %w", t.Name, field, err)
+		}
+
+		foundIds := make([]string, 0, len(found))
+		foundObjs := make([]Object, 0, len(found))
+		for id, obj := range found {
+			foundIds = append(foundIds, id)
+			foundObjs = append(foundObjs, obj)
+		}
+		nested, err := s.expand(target, foundObjs, tree[field])
+		if err != nil {
+			return nil, err
+		}
+		byId := map[string]Object{}
+		for i, id := range foundIds {
+			byId[id] = nested[i]
+		}
+
+		for _, obj := range expanded {
+			id, err := idToString(obj[field])
+			if err != nil {
+				continue
+			}
+			if ref, ok := byId[id]; ok {
+				obj[field] = ref
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// getMany fetches objects by id, in one call when the provider supports it.
+func (s Server) getMany(t Type, ids []string) (map[string]Object, error) {
+	if batch, ok := s.DataStore.(BatchGetter); ok {
+		return batch.GetMany(t, ids)
+	}
+
+	found := map[string]Object{}
+	for _, id := range ids {
+		obj, err := s.DataStore.Get(t, id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		found[id] = obj
+	}
+	return found, nil
+}
+
+func copyObject(obj Object) Object {
+	c := Object{}
+	for k, v := range obj {
+		c[k] = v
+	}
+	return c
+}
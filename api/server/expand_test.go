@@ -0,0 +1,101 @@
+package server_test
+
+import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"testing"
+)
+
+var CompaniesType = server.Type{Name: "companies", Id: "id", Schema:
+// language=json
+`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"name": { "type": "string" }
+	}
+}`}
+
+var EmployeesType = server.Type{Name: "users", Id: "id", Schema:
+// language=json
+`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"name": { "type": "string" },
+		"company": { "type": "string", "x-ref": "companies" }
+	}
+}`}
+
+func expansionStore(t *testing.T) datastore.Memory {
+	pets := petsType(server.OnDeleteRestrict)
+	store, err := datastore.NewMemory(
+		datastore.Record{Type: CompaniesType, Id: "c", Data: server.Object{"id": "c", "name": "acme"}},
+		datastore.Record{Type: EmployeesType, Id: "1", Data: server.Object{"id": "1", "name": "chris", "company": "c"}},
+		datastore.Record{Type: pets, Id: "1", Data: server.Object{"id": "1", "owner": "1"}},
+		datastore.Record{Type: pets, Id: "2", Data: server.Object{"id": "2", "owner": "1"}},
+		datastore.Record{Type: pets, Id: "3", Data: server.Object{"id": "3", "owner": "missing"}},
+	)
+	require.NoError(t, err)
+	return store
+}
+
+func TestServer_GetExpandsRelations(t *testing.T) {
+	store := expansionStore(t)
+	url, closeFn := startServer(store, CompaniesType, EmployeesType, petsType(server.OnDeleteRestrict))
+	defer closeFn()
+
+	body := getBody(t, fmt.Sprintf("%s/pets/1?expand=owner", url), http.StatusOK)
+	assert.JSONEq(t, `{"id": "1", "owner": {"id": "1", "name": "chris", "company": "c"}}`, body)
+
+	stored, err := store.Get(petsType(server.OnDeleteRestrict), "1")
+	require.NoError(t, err)
+	assert.Equal(t, "1", stored["owner"])
+}
+
+func TestServer_ListExpandsNestedRelations(t *testing.T) {
+	store := expansionStore(t)
+	url, closeFn := startServer(store, CompaniesType, EmployeesType, petsType(server.OnDeleteRestrict))
+	defer closeFn()
+
+	body := getBody(t, fmt.Sprintf("%s/pets?expand=owner.company", url), http.StatusOK)
+	assert.JSONEq(t, `[
+		{"id": "1", "owner": {"id": "1", "name": "chris", "company": {"id": "c", "name": "acme"}}},
+		{"id": "2", "owner": {"id": "1", "name": "chris", "company": {"id": "c", "name": "acme"}}},
+		{"id": "3", "owner": "missing"}
+	]`, body)
+}
+
+func TestServer_ExpandRejectsUnknownAndDeepPaths(t *testing.T) {
+	store := expansionStore(t)
+	url := startConfiguredServer(t, store, []server.Type{CompaniesType, EmployeesType, petsType(server.OnDeleteRestrict)}, withMaxExpandDepth(1))
+
+	getBody(t, fmt.Sprintf("%s/pets?expand=name", url), http.StatusBadRequest)
+	getBody(t, fmt.Sprintf("%s/pets?expand=owner.company", url), http.StatusBadRequest)
+	getBody(t, fmt.Sprintf("%s/pets?expand=owner", url), http.StatusOK)
+}
+
+func TestServer_DescribesRelations(t *testing.T) {
+	store := expansionStore(t)
+	url, closeFn := startServer(store, CompaniesType, EmployeesType, petsType(server.OnDeleteRestrict))
+	defer closeFn()
+
+	body := getBody(t, fmt.Sprintf("%s/describe", url), http.StatusOK)
+	assert.Contains(t, body, `"relations":[{"field":"owner","type":"users","onDelete":"restrict"}]`)
+}
+
+func getBody(t *testing.T, url string, status int) string {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, status, resp.StatusCode, string(body))
+	return string(body)
+}
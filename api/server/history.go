@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Historian is implemented by providers that keep the prior versions of objects themselves, e.g. as object
+// generations. The server keeps versions in a history type of each type for providers that don't.
+type Historian interface {
+	// KeepsHistory reports whether versions are being kept, it may depend on how the store is set up.
+	KeepsHistory() bool
+	// History lists every version written of an object, oldest first. It returns ErrNotFound when there are none.
+	History(t Type, id string) ([]Version, error)
+	// Version reads a version of an object, returning ErrNotFound when there is no such version.
+	Version(t Type, id string, version string) (Object, error)
+	// Forget removes every version kept of an object, once it is purged.
+	Forget(t Type, id string) error
+}
+
+// Version identifies a version of an object, the last one is its current version unless the object was deleted.
+type Version struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+// historyType is where the server keeps versions of objects of t when the provider doesn't, indexed by object id.
+func (t Type) historyType() Type {
+	return Type{Name: t.Name + "/_history", Id: "key", Indexes: []string{"objectId"}, Schema: `{"type": "object"}`}
+}
+
+func (s Server) historian() (Historian, bool) {
+	historian, ok := s.DataStore.(Historian)
+	return historian, ok && historian.KeepsHistory()
+}
+
+// record keeps obj as a version of the object when the provider doesn't keep history itself.
+func (s Server) record(t Type, id string, obj Object) error {
+	if _, ok := s.historian(); ok {
+		return nil
+	}
+	now := time.Now().UTC()
+	version := strconv.FormatInt(now.UnixNano(), 10)
+	key := url.PathEscape(id) + "." + version
+	err := s.DataStore.Create(t.historyType(), key, Object{"key": key, "objectId": id, "version": version, "time": now.Format(time.RFC3339Nano), "object": obj})
+	if err != nil {
+		return fmt.Errorf("unable to keep version of %s %s: %w", t.Name, id, err)
+	}
+	return nil
+}
+
+func (s Server) history(t Type, id string) ([]Version, error) {
+	if historian, ok := s.historian(); ok {
+		return historian.History(t, id)
+	}
+
+	entries, err := s.list(t.historyType(), filters{"objectId": {id}})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no history of %s %s: %w", t.Name, id, ErrNotFound)
+	}
+	versions := make([]Version, 0, len(entries))
+	for _, entry := range entries {
+		version, _ := IndexValue(entry["version"])
+		at, _ := IndexValue(entry["time"])
+		recorded, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read version %s of %s %s: %w", version, t.Name, id, err)
+		}
+		versions = append(versions, Version{Version: version, Time: recorded})
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Time.Before(versions[j].Time)
+	})
+	return versions, nil
+}
+
+func (s Server) version(t Type, id string, version string) (Object, error) {
+	if historian, ok := s.historian(); ok {
+		return historian.Version(t, id, version)
+	}
+
+	entry, err := s.DataStore.Get(t.historyType(), url.PathEscape(id)+"."+version)
+	if err != nil {
+		return nil, fmt.Errorf("no version %s of %s %s: %w", version, t.Name, id, err)
+	}
+	switch obj := entry["object"].(type) {
+	case Object:
+		return copyObject(obj), nil
+	case map[string]interface{}:
+		return obj, nil
+	default:
+		return nil, fmt.Errorf("version %s of %s %s holds no object", version, t.Name, id)
+	}
+}
+
+// forget removes the versions kept of an object, so none can be read or restored once it is purged.
+func (s Server) forget(t Type, id string) error {
+	if historian, ok := s.historian(); ok {
+		return historian.Forget(t, id)
+	}
+
+	entries, err := s.list(t.historyType(), filters{"objectId": {id}})
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		key, _ := IndexValue(entry["key"])
+		err = s.DataStore.Delete(t.historyType(), key)
+		if err != nil {
+			return fmt.Errorf("unable to remove version of %s %s: %w", t.Name, id, err)
+		}
+	}
+	return nil
+}
+
+// authorizeHistory checks the principal owns the latest version of an object before its history is revealed.
+func (s Server) authorizeHistory(ctx context.Context, t Type, id string) ([]Version, error) {
+	versions, err := s.history(t.writeType(), id)
+	if err != nil {
+		return nil, err
+	}
+	if _, restricted := s.ownedBy(ctx, t); restricted {
+		latest, err := s.version(t.writeType(), id, versions[len(versions)-1].Version)
+		if err != nil {
+			return nil, err
+		}
+		if !s.owns(ctx, t, latest) {
+			return nil, fmt.Errorf("no history of %s %s: %w", t.Name, id, ErrNotFound)
+		}
+	}
+	return versions, nil
+}
+
+// addHistoryEndpoints serves the versions of the objects of t. Versions are kept of the objects written through the
+// api, the drafts of types with a draft workflow, so restoring a version saves it as a draft.
+func (s Server) addHistoryEndpoints(r chi.Router, t Type, validator Validator) {
+	r.With(s.authorize(ScopeRead, t.Name)).Get(fmt.Sprintf("/%s/{id}/_history", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+		versions, err := s.authorizeHistory(request.Context(), t, chi.URLParam(request, "id"))
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		writeJSON(writer, versions)
+	})
+
+	r.With(s.authorize(ScopeRead, t.Name)).Get(fmt.Sprintf("/%s/{id}/_history/{version}", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+		id := chi.URLParam(request, "id")
+		_, err := s.authorizeHistory(request.Context(), t, id)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		obj, err := s.version(t.writeType(), id, chi.URLParam(request, "version"))
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		s.hide(request.Context(), t, []Object{obj}, nil)
+		writeJSON(writer, obj)
+	})
+
+	r.With(s.authorize(ScopeWrite, t.Name)).Post(fmt.Sprintf("/%s/{id}/_restore/{version}", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+		id := chi.URLParam(request, "id")
+		_, err := s.authorizeHistory(request.Context(), t, id)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		obj, err := s.version(t.writeType(), id, chi.URLParam(request, "version"))
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+
+		_, err = s.authorizeWrite(request.Context(), t, id, obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		_, err = s.authorizeOwner(request.Context(), t, id, obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		valid, validationErrors, err := validator.Validate(string(b))
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		if !valid {
+			handleValidationError(writer, validationErrors)
+			return
+		}
+		referenceErrors, err := s.checkReferences(t, obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		if len(referenceErrors) > 0 {
+			handleValidationError(writer, referenceErrors)
+			return
+		}
+
+		before := s.auditBefore(t, id, StageDraft)
+		err = s.update(t.writeType(), id, obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		s.audit(request.Context(), t, id, OpRestore, before, obj)
+
+		restored := copyObject(obj)
+		s.hide(request.Context(), t, []Object{restored}, nil)
+		writeJSON(writer, restored)
+	})
+}
@@ -0,0 +1,55 @@
+package server_test
+
+import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func TestServer_HistoryRestoresVersions(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	url, closeFn := startServer(store, BasicType)
+	defer closeFn()
+
+	assertRestoresVersions(t, url)
+}
+
+func TestServer_HistoryIsKeptForProvidersWithout(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	// hides the History method of the memory store
+	url := startConfiguredServer(t, struct{ server.DataProvider }{store}, []server.Type{BasicType})
+
+	assertRestoresVersions(t, url)
+}
+
+func assertRestoresVersions(t *testing.T, url string) {
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "1", "name": "chris"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/user/1", url), `{"id": "1", "name": "oops"}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/user/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var versions []server.Version
+	require.NoError(t, json.Unmarshal([]byte(getBody(t, fmt.Sprintf("%s/user/1/_history", url), http.StatusOK)), &versions))
+	require.Len(t, versions, 2)
+	first := versions[0].Version
+	assert.JSONEq(t, `{"id": "1", "name": "chris"}`, getBody(t, fmt.Sprintf("%s/user/1/_history/%s", url, first), http.StatusOK))
+	getBody(t, fmt.Sprintf("%s/user/1/_history/nope", url), http.StatusNotFound)
+	getBody(t, fmt.Sprintf("%s/user/2/_history", url), http.StatusNotFound)
+
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/user/1/_restore/%s", url, first), "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"id": "1", "name": "chris"}`, readBody(t, resp))
+	assert.JSONEq(t, `{"id": "1", "name": "chris"}`, getBody(t, fmt.Sprintf("%s/user/1", url), http.StatusOK))
+
+	require.NoError(t, json.Unmarshal([]byte(getBody(t, fmt.Sprintf("%s/user/1/_history", url), http.StatusOK)), &versions))
+	assert.Len(t, versions, 3, "restoring writes a new version")
+}
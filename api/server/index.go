@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Finder is implemented by providers that maintain an index for each of Type.IndexedFields, so
+// objects can be looked up by the value of one of those fields without listing the whole type.
+type Finder interface {
+	Find(t Type, field string, value string) ([]Object, error)
+}
+
+// Reindexer is implemented by providers that can rebuild the indexes of a type from its stored objects.
+type Reindexer interface {
+	Reindex(t Type) error
+}
+
+// Reindex rebuilds the indexes of every type. It should be run while nothing else writes to the store.
+func Reindex(store DataProvider, types []Type) error {
+	reindexer, ok := store.(Reindexer)
+	if !ok {
+		return fmt.Errorf("provider %T doesn't keep indexes", store)
+	}
+	for _, t := range types {
+		err := reindexer.Reindex(t)
+		if err != nil {
+			return fmt.Errorf("unable to reindex %s: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// IndexedFields lists the fields providers should index for lookups: relation, unique, configured index and owner fields.
+// The schema is only parsed for the relations of types that aren't from a started server.
+func (t Type) IndexedFields() []string {
+	fields := append(make([]string, 0), t.relationFields...)
+	if t.relationFields == nil {
+		relations, err := t.Relations()
+		if err == nil {
+			for _, r := range relations {
+				fields = append(fields, r.Field)
+			}
+		}
+	}
+	for _, configured := range [][]string{t.Unique, t.Indexes, {t.Owner}} {
+		for _, field := range configured {
+			if field != "" && !contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// IndexValue is the string a field value is indexed under. Only scalar values can be indexed.
+func IndexValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(v), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case json.Number:
+		return v.String(), true
+	default:
+		return "", false
+	}
+}
+
+// find lists the objects of type t where field has value, using the provider index when there is one.
+func (s Server) find(t Type, field string, value string) ([]Object, error) {
+	if finder, ok := s.DataStore.(Finder); ok && contains(t.IndexedFields(), field) {
+		return finder.Find(t, field, value)
+	}
+
+	all, err := s.DataStore.List(t)
+	if err != nil {
+		return nil, err
+	}
+	matching := make([]Object, 0)
+	for _, obj := range all {
+		if v, ok := IndexValue(obj[field]); ok && v == value {
+			matching = append(matching, obj)
+		}
+	}
+	return matching, nil
+}
+
+// filters are equality conditions on top level fields, an object matches when each field holds one of its values.
+type filters map[string][]string
+
+// parseFilters reads the filters from the query parameters. Parameters starting with an underscore, such as
+// the paging parameters sent by the admin UI, and those with other meanings are not filters.
+func parseFilters(query url.Values) filters {
+	f := filters{}
+	for param, values := range query {
+		if strings.HasPrefix(param, "_") || contains(reservedParams, param) {
+			continue
+		}
+		f[param] = values
+	}
+	return f
+}
+
+var reservedParams = []string{"expand", "groupBy", "metric", "stage"}
+
+func (f filters) fields() []string {
+	fields := make([]string, 0, len(f))
+	for field := range f {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (f filters) matches(obj Object) bool {
+	for field, values := range f {
+		value, ok := IndexValue(obj[field])
+		if !ok || !contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// list returns the objects of type t matching the filters. When one of the filtered fields is indexed the
+// provider looks up the objects holding its values, otherwise every object is read and filtered.
+func (s Server) list(t Type, f filters) ([]Object, error) {
+	indexedField := ""
+	if _, ok := s.DataStore.(Finder); ok {
+		for _, field := range f.fields() {
+			if contains(t.IndexedFields(), field) {
+				indexedField = field
+				break
+			}
+		}
+	}
+
+	var candidates []Object
+	if indexedField == "" {
+		all, err := s.DataStore.List(t)
+		if err != nil {
+			return nil, err
+		}
+		candidates = all
+	} else {
+		seen := map[string]bool{}
+		for _, value := range f[indexedField] {
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+			found, err := s.find(t, indexedField, value)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, found...)
+		}
+		sortById(t, candidates)
+	}
+
+	matching := make([]Object, 0)
+	for _, obj := range candidates {
+		if f.matches(obj) {
+			matching = append(matching, obj)
+		}
+	}
+	return matching, nil
+}
+
+func sortById(t Type, objs []Object) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		a, _ := IndexValue(objs[i][t.Id])
+		b, _ := IndexValue(objs[j][t.Id])
+		return a < b
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
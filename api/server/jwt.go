@@ -0,0 +1,264 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRolesClaim is the claim roles are read from when JWTConfig.RolesClaim isn't set.
+const DefaultRolesClaim = "roles"
+
+// jwksRefreshInterval limits how often the key set is fetched again when a token is signed by an unknown key.
+const jwksRefreshInterval = time.Minute
+
+// JWTConfig configures the bearer tokens accepted by the server, signed by a key from the JWKS URL of an identity
+// provider or by one of the static public keys.
+type JWTConfig struct {
+	JWKSURL string
+	// Keys are PEM encoded public keys.
+	Keys     []string
+	Issuer   string
+	Audience string
+	// Leeway is the clock skew allowed when checking the expiry and not before times.
+	Leeway time.Duration
+	// RolesClaim is the claim holding the roles of the principal, nested claims can be read with a dot separated path
+	// such as realm_access.roles. The claim can be a list or a space separated string.
+	RolesClaim string
+}
+
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+type tokenVerifier struct {
+	config JWTConfig
+	keys   []crypto.PublicKey
+	jwks   *jwks
+}
+
+func newTokenVerifier(config JWTConfig) (*tokenVerifier, error) {
+	if config.JWKSURL == "" && len(config.Keys) == 0 {
+		return nil, errors.New("jwt auth needs a JWKS URL or keys")
+	}
+
+	verifier := &tokenVerifier{config: config}
+	for i, key := range config.Keys {
+		block, _ := pem.Decode([]byte(key))
+		if block == nil {
+			return nil, fmt.Errorf("jwt key %d is not PEM encoded", i)
+		}
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse jwt key %d: %w", i, err)
+		}
+		verifier.keys = append(verifier.keys, publicKey)
+	}
+	if config.JWKSURL != "" {
+		verifier.jwks = &jwks{url: config.JWKSURL, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return verifier, nil
+}
+
+// principal verifies the token and returns the principal named by its subject, holding the roles of its roles claim.
+func (v *tokenVerifier) principal(tokenString string, roles map[string]Role) (Principal, error) {
+	options := []jwt.ParserOption{jwt.WithValidMethods(signingMethods), jwt.WithLeeway(v.config.Leeway)}
+	if v.config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(v.config.Issuer))
+	}
+	if v.config.Audience != "" {
+		options = append(options, jwt.WithAudience(v.config.Audience))
+	}
+
+	var token *jwt.Token
+	var err error
+	for _, key := range v.candidates(tokenString) {
+		key := key
+		token, err = jwt.Parse(tokenString, func(*jwt.Token) (interface{}, error) { return key, nil }, options...)
+		if err == nil || !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			break
+		}
+	}
+	if token == nil && err == nil {
+		err = errors.New("no key to verify the token")
+	}
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: invalid token: %s", ErrUnauthorized, err)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	expiry, err := claims.GetExpirationTime()
+	if err != nil || expiry == nil {
+		return Principal{}, fmt.Errorf("%w: invalid token: missing expiry", ErrUnauthorized)
+	}
+	// the subject names the principal, as the owner of its objects and in the audit log
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return Principal{}, fmt.Errorf("%w: invalid token: missing subject", ErrUnauthorized)
+	}
+
+	return newPrincipal(KindToken, subject, nil, roles, claimRoles(claims, v.config.RolesClaim)), nil
+}
+
+// candidates returns the keys that may have signed the token: the JWKS key with its key id, and the static keys.
+func (v *tokenVerifier) candidates(tokenString string) []crypto.PublicKey {
+	candidates := make([]crypto.PublicKey, 0)
+	if v.jwks != nil {
+		token, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+		if err == nil {
+			kid, _ := token.Header["kid"].(string)
+			if key := v.jwks.key(kid); key != nil {
+				candidates = append(candidates, key)
+			}
+		}
+	}
+	return append(candidates, v.keys...)
+}
+
+func claimRoles(claims jwt.MapClaims, path string) []string {
+	if path == "" {
+		path = DefaultRolesClaim
+	}
+	var value interface{} = map[string]interface{}(claims)
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{}
+		}
+		value = object[name]
+	}
+
+	roles := make([]string, 0)
+	switch v := value.(type) {
+	case string:
+		roles = strings.Fields(v)
+	case []interface{}:
+		for _, role := range v {
+			if name, ok := role.(string); ok {
+				roles = append(roles, name)
+			}
+		}
+	}
+	return roles
+}
+
+// jwks caches the keys published by an identity provider, fetching them again when a token uses a key it doesn't know.
+type jwks struct {
+	url    string
+	client *http.Client
+
+	lock    sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func (j *jwks) key(kid string) crypto.PublicKey {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if key, found := j.keys[kid]; found {
+		return key
+	}
+	if time.Since(j.fetched) < jwksRefreshInterval {
+		return nil
+	}
+	j.fetched = time.Now()
+	keys, err := j.fetch()
+	if err != nil {
+		// keep the keys we have, the provider may be briefly unavailable
+		log.Printf("unable to fetch jwks: %s \n", err)
+		return nil
+	}
+	j.keys = keys
+	return j.keys[kid]
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (j *jwks) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", j.url, resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode jwks: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key %s: %w", jwk.Kid, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes RSA and EC keys, keys of other types are skipped.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, found := curves[k.Crv]
+		if !found {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, nil
+	}
+}
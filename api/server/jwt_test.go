@@ -0,0 +1,152 @@
+package server_test
+
+import (
+	"crswty.com/cms/server"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var tokenRoles = map[string]server.Role{
+	"viewer": {Permissions: map[string][]server.Scope{"user": {server.ScopeRead}}},
+	"editor": {Permissions: map[string][]server.Scope{"user": {server.ScopeRead, server.ScopeWrite}}},
+}
+
+// startJWKSServer publishes the public half of key under kid the way identity providers do.
+func startJWKSServer(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	jwks := map[string]interface{}{"keys": []map[string]string{{
+		"kid": kid,
+		"kty": "RSA",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_ = json.NewEncoder(writer).Encode(jwks)
+	}))
+	t.Cleanup(jwksServer.Close)
+	return jwksServer.URL
+}
+
+// withJWT authenticates requests with tokens checked by the config, granting the tokenRoles.
+func withJWT(config server.JWTConfig) serverOption {
+	return withAuth(server.AuthConfig{JWT: &config, Roles: tokenRoles})
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func bearerRequest(t *testing.T, method string, url string, token string) int {
+	request, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	return resp.StatusCode
+}
+
+func claims(roles ...string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":   "chris",
+		"iss":   "https://id.example.com",
+		"aud":   "cms",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": roles,
+	}
+}
+
+func TestServer_AcceptsTokensSignedByJWKSKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withJWT(server.JWTConfig{
+		JWKSURL:  startJWKSServer(t, "key-1", key),
+		Issuer:   "https://id.example.com",
+		Audience: "cms",
+	}))
+
+	viewer := signToken(t, jwt.SigningMethodRS256, "key-1", key, claims("viewer"))
+	assert.Equal(t, http.StatusOK, bearerRequest(t, http.MethodGet, fmt.Sprintf("%s/user/1", url), viewer))
+	assert.Equal(t, http.StatusForbidden, bearerRequest(t, http.MethodDelete, fmt.Sprintf("%s/user/1", url), viewer))
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	forged := signToken(t, jwt.SigningMethodRS256, "key-1", other, claims("editor"))
+	assert.Equal(t, http.StatusUnauthorized, bearerRequest(t, http.MethodGet, fmt.Sprintf("%s/user/1", url), forged))
+	unknown := signToken(t, jwt.SigningMethodRS256, "key-2", other, claims("editor"))
+	assert.Equal(t, http.StatusUnauthorized, bearerRequest(t, http.MethodGet, fmt.Sprintf("%s/user/1", url), unknown))
+}
+
+func TestServer_ValidatesTokenClaims(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withJWT(server.JWTConfig{
+		JWKSURL:  startJWKSServer(t, "key-1", key),
+		Issuer:   "https://id.example.com",
+		Audience: "cms",
+		Leeway:   time.Minute,
+	}))
+
+	tests := map[string]struct {
+		claims func(jwt.MapClaims)
+		status int
+	}{
+		"valid":                {func(c jwt.MapClaims) {}, http.StatusOK},
+		"wrong issuer":         {func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, http.StatusUnauthorized},
+		"wrong audience":       {func(c jwt.MapClaims) { c["aud"] = "other" }, http.StatusUnauthorized},
+		"expired within skew":  {func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }, http.StatusOK},
+		"expired":              {func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, http.StatusUnauthorized},
+		"without expiry":       {func(c jwt.MapClaims) { delete(c, "exp") }, http.StatusUnauthorized},
+		"without subject":      {func(c jwt.MapClaims) { delete(c, "sub") }, http.StatusUnauthorized},
+		"empty subject":        {func(c jwt.MapClaims) { c["sub"] = "" }, http.StatusUnauthorized},
+		"non string subject":   {func(c jwt.MapClaims) { c["sub"] = 42 }, http.StatusUnauthorized},
+		"without granted role": {func(c jwt.MapClaims) { c["roles"] = []string{"guest"} }, http.StatusForbidden},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := claims("viewer")
+			test.claims(c)
+			token := signToken(t, jwt.SigningMethodRS256, "key-1", key, c)
+			assert.Equal(t, test.status, bearerRequest(t, http.MethodGet, fmt.Sprintf("%s/user/1", url), token))
+		})
+	}
+}
+
+func TestServer_AcceptsTokensSignedByStaticKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withJWT(server.JWTConfig{
+		Keys:       []string{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))},
+		RolesClaim: "realm_access.roles",
+	}))
+
+	c := claims()
+	c["realm_access"] = map[string]interface{}{"roles": []string{"editor"}}
+	token := signToken(t, jwt.SigningMethodES256, "", key, c)
+	assert.Equal(t, http.StatusOK, bearerRequest(t, http.MethodGet, fmt.Sprintf("%s/user/1", url), token))
+
+	unsigned := signToken(t, jwt.SigningMethodHS256, "", []byte("secret"), c)
+	assert.Equal(t, http.StatusUnauthorized, bearerRequest(t, http.MethodGet, fmt.Sprintf("%s/user/1", url), unsigned))
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"time"
+)
+
+// Leaser is implemented by providers that can hand out leases, so only one of several instances sharing the store
+// does work such as applying schedules at a time.
+type Leaser interface {
+	// Lease acquires or renews the named lease for holder until ttl from now, reporting whether holder has it.
+	Lease(name string, holder string, ttl time.Duration) (bool, error)
+}
+
+func newInstanceId() string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	host, _ := os.Hostname()
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// runLeased calls work every interval until the context is done, while this instance holds the named lease. work
+// calls renew before every step, which extends the lease and reports false once it is lost, so another instance only
+// takes the lease over once the holder has stopped working. Leases last a few intervals, and at least twice step,
+// the longest a step of work can take.
+func (s Server) runLeased(ctx context.Context, name string, interval time.Duration, step time.Duration, work func(now time.Time, renew func() bool) error) {
+	leaser, leases := s.DataStore.(Leaser)
+	if !leases {
+		log.Printf("provider %T can't lease, %s should only be run by one instance \n", s.DataStore, name)
+	}
+	ttl := 3 * interval
+	if 2*step > ttl {
+		ttl = 2 * step
+	}
+	lease := func() (bool, error) {
+		if !leases {
+			return true, nil
+		}
+		return leaser.Lease(name, s.instance, ttl)
+	}
+	renew := func() bool {
+		held, err := lease()
+		if err != nil {
+			log.Printf("Error renewing the %s lease: %s \n", name, err)
+		}
+		return err == nil && held
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		held, err := lease()
+		if err == nil && held {
+			err = work(time.Now(), renew)
+		}
+		if err != nil {
+			log.Printf("Error running %s: %s \n", name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
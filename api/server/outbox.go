@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultOutboxInterval is how often the outbox is relayed when Config.OutboxInterval isn't set.
+	DefaultOutboxInterval = time.Second
+	// outboxGrace is how long an entry can stay pending before the relay settles it from the stored object, writes
+	// in progress commit their entries well before.
+	outboxGrace = time.Minute
+	// outboxRetention is how long relayed entries are kept, so every instance has time to pass them to its streams.
+	outboxRetention = time.Minute
+	// outboxStep bounds how long a consumer can take to handle an event, the lease outlasts it.
+	outboxStep  = 10 * time.Second
+	outboxLease = "outbox"
+)
+
+// Outbox entry statuses.
+const (
+	outboxPending   = "pending"
+	outboxCommitted = "committed"
+)
+
+// outboxEntry is an event recorded in the provider before the write it describes is made, and committed after it.
+// Entries left pending by an instance stopping in between are committed or dropped by the relay, depending on
+// whether the write was made.
+type outboxEntry struct {
+	Id       string `json:"id"`
+	Instance string `json:"instance"`
+	Status   string `json:"status"`
+	Event    Event  `json:"event"`
+	// Deleted is the object removed by a delete, kept so streams can check who may see the event.
+	Deleted Object `json:"deleted,omitempty"`
+	// Consumed lists the consumers the relay has handed the event to.
+	Consumed []string  `json:"consumed"`
+	Created  time.Time `json:"created"`
+}
+
+var outboxType = Type{Name: "_outbox", Id: "id", Schema: `{"type": "object"}`}
+
+func (entry outboxEntry) event() Event {
+	e := entry.Event
+	e.Key = entry.Id
+	e.deleted = entry.Deleted
+	return e
+}
+
+// outboxConsumer is handed every committed event once, in order, by the instance holding the outbox lease.
+type outboxConsumer struct {
+	name   string
+	handle func(e Event) error
+}
+
+// prepare records the event as pending in the outbox when it is on, the event returned refers to the entry.
+func (s Server) prepare(e Event) (Event, error) {
+	if !s.Config.Outbox {
+		return e, nil
+	}
+	e.Key = newSortableId(e.Time)
+	entry := outboxEntry{Id: e.Key, Instance: s.instance, Status: outboxPending, Event: e, Deleted: e.deleted, Created: e.Time}
+	err := s.putEntry(entry, true)
+	if err != nil {
+		return e, fmt.Errorf("unable to record %s of %s %s in the outbox: %w", e.Operation, e.Type, e.ObjectId, err)
+	}
+	return e, nil
+}
+
+// commit marks the entry of an event whose change has been made, when this fails the relay settles it.
+func (s Server) commit(e Event) {
+	if e.Key == "" {
+		return
+	}
+	entry := outboxEntry{Id: e.Key, Instance: s.instance, Status: outboxCommitted, Event: e, Deleted: e.deleted, Created: e.Time}
+	err := s.putEntry(entry, false)
+	if err != nil {
+		log.Printf("Error committing event %s: %s \n", e.Key, err)
+	}
+}
+
+// abandon removes the entry of an event whose change failed.
+func (s Server) abandon(e Event) {
+	if e.Key == "" {
+		return
+	}
+	err := s.DataStore.Delete(outboxType, e.Key)
+	if err != nil {
+		log.Printf("Error abandoning event %s: %s \n", e.Key, err)
+	}
+}
+
+func (s Server) putEntry(entry outboxEntry, create bool) error {
+	obj, err := marshalObject(entry)
+	if err != nil {
+		return err
+	}
+	if create {
+		return s.DataStore.Create(outboxType, entry.Id, obj)
+	}
+	return s.DataStore.Update(outboxType, entry.Id, obj)
+}
+
+func (s Server) entries() ([]outboxEntry, error) {
+	objs, err := s.DataStore.List(outboxType)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]outboxEntry, 0, len(objs))
+	for _, obj := range objs {
+		var entry outboxEntry
+		err = unmarshalObject(obj, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read outbox entry %v: %w", obj["id"], err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id < entries[j].Id
+	})
+	return entries, nil
+}
+
+// RunOutbox relays the events committed to the outbox every Config.OutboxInterval until the context is done. Every
+// instance passes the events of the writes made by the others to its event streams, the one holding the lease hands
+// every event once to the webhooks and to each publisher.
+func (s *Server) RunOutbox(ctx context.Context) {
+	if !s.Config.Outbox {
+		return
+	}
+	interval := s.Config.OutboxInterval
+	if interval == 0 {
+		interval = DefaultOutboxInterval
+	}
+	go s.runLeased(ctx, outboxLease, interval, outboxStep, func(now time.Time, renew func() bool) error {
+		return s.relay(s.consumers(ctx), now, renew)
+	})
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	relayed := map[string]bool{}
+	started := false
+	for {
+		err := s.fanIn(relayed, !started)
+		if err != nil {
+			log.Printf("Error relaying the outbox to event streams: %s \n", err)
+		}
+		started = started || err == nil
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s Server) consumers(ctx context.Context) []outboxConsumer {
+	consumers := make([]outboxConsumer, 0)
+	if len(s.Config.Webhooks) > 0 {
+		consumers = append(consumers, outboxConsumer{name: "webhooks", handle: s.queue})
+	}
+	// publishers are told apart by their position in the config
+	for i, p := range s.Config.Publishers {
+		p := p
+		consumers = append(consumers, outboxConsumer{name: fmt.Sprintf("publisher-%d", i), handle: func(e Event) error {
+			ctx, cancel := context.WithTimeout(ctx, outboxStep)
+			defer cancel()
+			return p.Publish(ctx, e)
+		}})
+	}
+	return consumers
+}
+
+// fanIn publishes the committed events of the other instances to the event streams of this one, skip marks the
+// entries as relayed without publishing them, so streams don't start with events from before the instance started.
+func (s Server) fanIn(relayed map[string]bool, skip bool) error {
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+	present := map[string]bool{}
+	for _, entry := range entries {
+		present[entry.Id] = true
+		if entry.Status != outboxCommitted || relayed[entry.Id] {
+			continue
+		}
+		relayed[entry.Id] = true
+		if !skip && entry.Instance != s.instance {
+			s.events.publish(entry.event())
+		}
+	}
+	for id := range relayed {
+		if !present[id] {
+			delete(relayed, id)
+		}
+	}
+	return nil
+}
+
+// relay hands the committed events to the consumers that haven't had them, oldest first, and removes the entries
+// every consumer has had once they are past the retention. It stops at the first entry still being written, and
+// skips the remaining events for a consumer failing to handle one, so every consumer sees the events in order. The
+// lease is renewed before every event handed over, the relay stops once another instance holds it.
+func (s Server) relay(consumers []outboxConsumer, now time.Time, renew func() bool) error {
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+	failed := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Status == outboxPending {
+			if now.Sub(entry.Created) < outboxGrace {
+				return nil
+			}
+			committed, err := s.settle(&entry)
+			if err != nil {
+				return err
+			}
+			if !committed {
+				continue
+			}
+		}
+
+		consumed := len(entry.Consumed)
+		for _, c := range consumers {
+			if failed[c.name] || contains(entry.Consumed, c.name) {
+				continue
+			}
+			if !renew() {
+				return s.putConsumed(entry, consumed)
+			}
+			err = c.handle(entry.event())
+			if err != nil {
+				failed[c.name] = true
+				log.Printf("Error handing event %s to %s: %s \n", entry.Id, c.name, err)
+				continue
+			}
+			entry.Consumed = append(entry.Consumed, c.name)
+		}
+		err = s.putConsumed(entry, consumed)
+		if err != nil {
+			return err
+		}
+
+		done := true
+		for _, c := range consumers {
+			done = done && contains(entry.Consumed, c.name)
+		}
+		if done && now.Sub(entry.Created) > outboxRetention {
+			err = s.DataStore.Delete(outboxType, entry.Id)
+			if err != nil {
+				return fmt.Errorf("unable to remove outbox entry %s: %w", entry.Id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// putConsumed saves the consumers an entry has been handed to, when there are more than the consumed it had.
+func (s Server) putConsumed(entry outboxEntry, consumed int) error {
+	if len(entry.Consumed) == consumed {
+		return nil
+	}
+	err := s.putEntry(entry, false)
+	if err != nil {
+		return fmt.Errorf("unable to update outbox entry %s: %w", entry.Id, err)
+	}
+	return nil
+}
+
+// settle commits an entry left pending when the write it records was made, and drops it otherwise.
+func (s Server) settle(entry *outboxEntry) (bool, error) {
+	written, err := s.written(entry.event())
+	if err != nil {
+		return false, fmt.Errorf("unable to settle outbox entry %s: %w", entry.Id, err)
+	}
+	if !written {
+		log.Printf("Dropping event %s, its %s of %s %s wasn't made \n", entry.Id, entry.Event.Operation, entry.Event.Type, entry.Event.ObjectId)
+		return false, s.DataStore.Delete(outboxType, entry.Id)
+	}
+	entry.Status = outboxCommitted
+	return true, s.putEntry(*entry, false)
+}
+
+// written reports whether the store holds the change an event describes: the object it wrote, or no object for
+// deletes.
+func (s Server) written(e Event) (bool, error) {
+	t := typeByName(s.Config.Types, e.Type)
+	if t == nil {
+		return false, nil
+	}
+	stored := *t
+	if e.Stage == StageDraft {
+		stored = t.draftType()
+	}
+	obj, err := s.DataStore.Get(stored, e.ObjectId)
+	if errors.Is(err, ErrNotFound) {
+		return e.Operation == OpDelete, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return e.Operation != OpDelete && reflect.DeepEqual(normalize(obj), normalize(e.Object)), nil
+}
@@ -0,0 +1,148 @@
+package server_test
+
+import (
+	"context"
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var outboxType = server.Type{Name: "_outbox", Id: "id", Schema: `{"type": "object"}`}
+
+// startOutboxInstance starts an instance sharing the store with the outbox relayed.
+func startOutboxInstance(t *testing.T, store server.DataProvider, config server.Config) string {
+	config.Types = []server.Type{BasicType}
+	config.Outbox = true
+	config.OutboxInterval = 10 * time.Millisecond
+	r := chi.NewRouter()
+	s, err := server.New(config, store)
+	require.NoError(t, err)
+	require.NoError(t, s.Start(r))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.RunOutbox(ctx)
+	go s.RunWebhooks(ctx)
+	testServer := httptest.NewServer(r)
+	t.Cleanup(testServer.Close)
+	return testServer.URL + "/api"
+}
+
+func TestServer_OutboxRelaysEventsOncePerConsumer(t *testing.T) {
+	hookUrl, received := hookReceiver(t, 0)
+	bus := &flakyPublisher{lock: &sync.Mutex{}, failures: 1}
+	config := server.Config{
+		Webhooks:        []server.Webhook{{Name: "rebuild", URL: hookUrl, Secret: "s3cret"}},
+		WebhookInterval: 10 * time.Millisecond,
+		Publishers:      []server.Publisher{bus},
+	}
+
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	first := startOutboxInstance(t, store, config)
+	second := startOutboxInstance(t, store, config)
+	// instances skip the entries in the outbox when they start
+	time.Sleep(50 * time.Millisecond)
+	streamed := openEvents(t, fmt.Sprintf("%s/user/_events", first), "", "")
+
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", second), `{"id": "1", "name": "chris"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", first), `{"id": "2", "name": "sam"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/user/1", second), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// the write made on the first instance is streamed straight away, the others once relayed, each once
+	changes := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		var e server.Event
+		require.NoError(t, json.Unmarshal([]byte(nextMessage(t, streamed).data), &e))
+		changes = append(changes, e.Operation+" "+e.ObjectId)
+	}
+	assert.ElementsMatch(t, []string{"create 1", "create 2", "delete 1"}, changes)
+	select {
+	case message := <-streamed:
+		assert.Fail(t, "unexpected event", message.data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.Eventually(t, func() bool {
+		events, _ := bus.published()
+		return len(events) == 3 && len(received()) == 3
+	}, 2*time.Second, 10*time.Millisecond)
+	// give the relay the chance to hand an event over twice
+	time.Sleep(100 * time.Millisecond)
+
+	events, _ := bus.published()
+	require.Len(t, events, 3)
+	assert.Equal(t, []string{"create", "create", "delete"}, []string{events[0].Operation, events[1].Operation, events[2].Operation})
+	assert.Equal(t, []string{"1", "2", "1"}, []string{events[0].ObjectId, events[1].ObjectId, events[2].ObjectId})
+	assert.True(t, events[0].Key < events[1].Key && events[1].Key < events[2].Key)
+	assert.Len(t, received(), 3)
+}
+
+func TestServer_OutboxSettlesEntriesLeftPending(t *testing.T) {
+	bus := &flakyPublisher{lock: &sync.Mutex{}}
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+
+	// an instance stopped after writing user 1, and before writing user 2
+	stale := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	require.NoError(t, store.Create(BasicType, "1", server.Object{"id": "1", "name": "chris"}))
+	require.NoError(t, store.Create(outboxType, "a", server.Object{
+		"id": "a", "instance": "stopped", "status": "pending", "created": stale,
+		"event": server.Object{"type": "user", "objectId": "1", "operation": "create", "object": server.Object{"id": "1", "name": "chris"}},
+	}))
+	require.NoError(t, store.Create(outboxType, "b", server.Object{
+		"id": "b", "instance": "stopped", "status": "pending", "created": stale,
+		"event": server.Object{"type": "user", "objectId": "2", "operation": "create", "object": server.Object{"id": "2", "name": "sam"}},
+	}))
+
+	startOutboxInstance(t, store, server.Config{Publishers: []server.Publisher{bus}})
+
+	require.Eventually(t, func() bool {
+		entries, err := store.List(outboxType)
+		require.NoError(t, err)
+		return len(entries) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	events, _ := bus.published()
+	require.Len(t, events, 1)
+	assert.Equal(t, "a", events[0].Key)
+	assert.Equal(t, "1", events[0].ObjectId)
+}
+
+func TestServer_OutboxHandsSlowPublishersEachEventOnce(t *testing.T) {
+	bus := &flakyPublisher{lock: &sync.Mutex{}, delay: 50 * time.Millisecond}
+	config := server.Config{Publishers: []server.Publisher{bus}}
+
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	urls := []string{startOutboxInstance(t, store, config), startOutboxInstance(t, store, config)}
+
+	for i := 1; i <= 4; i++ {
+		resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", urls[i%2]), fmt.Sprintf(`{"id": "%d", "name": "chris"}`, i), "")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	require.Eventually(t, func() bool {
+		events, _ := bus.published()
+		return len(events) >= 4
+	}, 2*time.Second, 10*time.Millisecond)
+	// give another instance the chance to take over while events are being published
+	time.Sleep(200 * time.Millisecond)
+	events, _ := bus.published()
+	keys := map[string]int{}
+	for _, e := range events {
+		keys[e.Key]++
+	}
+	assert.Len(t, keys, 4)
+	assert.Len(t, events, 4)
+}
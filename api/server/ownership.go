@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ownedBy returns the owner value of the principal when objects of t are restricted to those it owns, which is the case
+// for types with an owner field when the principal hasn't been granted ScopeAdmin on the type.
+func (s Server) ownedBy(ctx context.Context, t Type) (string, bool) {
+	if t.Owner == "" || !s.authEnabled() {
+		return "", false
+	}
+	principal, _ := PrincipalFrom(ctx)
+	if principal.Can(t.Name, ScopeAdmin) {
+		return "", false
+	}
+	return principal.Owner(), true
+}
+
+// restrict adds a filter on the owner field to f, so lists, their counts and aggregations only cover the objects
+// the principal owns. The owner field is indexed, so the filter doesn't read every object.
+func (s Server) restrict(ctx context.Context, t Type, f filters) filters {
+	owner, restricted := s.ownedBy(ctx, t)
+	if !restricted {
+		return f
+	}
+	owned := filters{}
+	for field, values := range f {
+		owned[field] = values
+	}
+	owned[t.Owner] = []string{owner}
+	if values, filtered := f[t.Owner]; filtered && !contains(values, owner) {
+		owned[t.Owner] = []string{}
+	}
+	return owned
+}
+
+func (s Server) owns(ctx context.Context, t Type, obj Object) bool {
+	owner, restricted := s.ownedBy(ctx, t)
+	if !restricted {
+		return true
+	}
+	value, ok := IndexValue(obj[t.Owner])
+	return ok && value == owner
+}
+
+func (s Server) ownedOnly(ctx context.Context, t Type, objs []Object) []Object {
+	owned := make([]Object, 0, len(objs))
+	for _, obj := range objs {
+		if s.owns(ctx, t, obj) {
+			owned = append(owned, obj)
+		}
+	}
+	return owned
+}
+
+// getOwned reads an object at the stage, reporting objects the principal doesn't own as not found so their ids
+// aren't revealed.
+func (s Server) getOwned(ctx context.Context, t Type, id string, stage string) (Object, error) {
+	obj, err := s.getStage(t, id, stage)
+	if err != nil {
+		return nil, err
+	}
+	if !s.owns(ctx, t, obj) {
+		return nil, fmt.Errorf("no object with id %s found: %w", id, ErrNotFound)
+	}
+	return obj, nil
+}
+
+// authorizeOwner checks the principal owns the object being written, id is empty for creates, and stamps the owner
+// field with the principal. Principals with ScopeAdmin can set the owner themselves, it is stamped when they don't.
+func (s Server) authorizeOwner(ctx context.Context, t Type, id string, obj Object) (stamped bool, err error) {
+	if t.Owner == "" || !s.authEnabled() {
+		return false, nil
+	}
+	owner, restricted := s.ownedBy(ctx, t)
+	if !restricted {
+		if _, set := obj[t.Owner]; set {
+			return false, nil
+		}
+		principal, _ := PrincipalFrom(ctx)
+		obj[t.Owner] = principal.Owner()
+		return true, nil
+	}
+
+	if id != "" {
+		stored, err := s.getStage(t, id, StageDraft)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		if err == nil && !s.owns(ctx, t, stored) {
+			return false, fmt.Errorf("no object with id %s found: %w", id, ErrNotFound)
+		}
+	}
+	if value, ok := IndexValue(obj[t.Owner]); ok && value == owner {
+		return false, nil
+	}
+	obj[t.Owner] = owner
+	return true, nil
+}
@@ -0,0 +1,134 @@
+package server_test
+
+import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var NotesType = server.Type{Name: "notes", Id: "id", Owner: "author", Schema:
+// language=json
+`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"required": ["id", "text", "author"],
+	"properties": {
+		"id": { "type": "string" },
+		"text": { "type": "string" },
+		"author": { "type": "string" }
+	}
+}`}
+
+var noteKeys = server.AuthConfig{APIKeys: []server.APIKey{
+	{Name: "alice", Hash: server.HashKey("alice-key"), Permissions: map[string][]server.Scope{"notes": {server.ScopeRead, server.ScopeWrite, server.ScopeDelete}}},
+	{Name: "bob", Hash: server.HashKey("bob-key"), Permissions: map[string][]server.Scope{"notes": {server.ScopeRead, server.ScopeWrite, server.ScopeDelete}}},
+	{Name: "moderator", Hash: server.HashKey("moderator-key"), Permissions: map[string][]server.Scope{
+		server.AnyType: {server.ScopeRead, server.ScopeWrite, server.ScopeDelete, server.ScopeAdmin},
+	}},
+}}
+
+var notes = []datastore.Record{
+	{Type: NotesType, Id: "1", Data: server.Object{"id": "1", "text": "alice's", "author": "key:alice"}},
+	{Type: NotesType, Id: "2", Data: server.Object{"id": "2", "text": "bob's", "author": "key:bob"}},
+	{Type: NotesType, Id: "3", Data: server.Object{"id": "3", "text": "bob's too", "author": "key:bob"}},
+}
+
+func TestServer_StampsOwnerOnCreate(t *testing.T) {
+	store := storeWith(t, notes...)
+	url := startConfiguredServer(t, store, []server.Type{NotesType}, withAuth(noteKeys))
+
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/notes", url), `{"id": "4", "text": "new"}`, "alice-key")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.JSONEq(t, `{"id": "4", "text": "new", "author": "key:alice"}`, readBody(t, resp))
+
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/notes/4", url), `{"id": "4", "text": "edited", "author": "key:bob"}`, "alice-key")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	stored, err := store.Get(NotesType, "4")
+	require.NoError(t, err)
+	assert.Equal(t, "key:alice", stored["author"])
+
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/notes", url), `{"id": "5", "text": "for bob", "author": "key:bob"}`, "moderator-key")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.JSONEq(t, `{"id": "5", "text": "for bob", "author": "key:bob"}`, readBody(t, resp))
+}
+
+func TestServer_RestrictsPrincipalsToOwnObjects(t *testing.T) {
+	url := startConfiguredServer(t, storeWith(t, notes...), []server.Type{NotesType}, withAuth(noteKeys))
+
+	resp := authRequest(t, http.MethodGet, fmt.Sprintf("%s/notes", url), "", "bob-key")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-Total-Count"))
+	assert.JSONEq(t, `[{"id": "2", "text": "bob's", "author": "key:bob"}, {"id": "3", "text": "bob's too", "author": "key:bob"}]`, readBody(t, resp))
+
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/notes?author=key:alice", url), "", "bob-key")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("X-Total-Count"))
+
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/notes/1", url), "", "bob-key")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/notes/1", url), `{"id": "1", "text": "mine now"}`, "bob-key")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/notes/1", url), "", "bob-key")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/notes/2", url), "", "bob-key")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/notes", url), "", "moderator-key")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-Total-Count"))
+}
+
+func TestServer_PostCantReplaceObjectsOfOtherOwners(t *testing.T) {
+	store := storeWith(t, notes...)
+	url := startConfiguredServer(t, store, []server.Type{NotesType}, withAuth(noteKeys))
+
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/notes", url), `{"id": "1", "text": "mine now"}`, "bob-key")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	stored, err := store.Get(NotesType, "1")
+	require.NoError(t, err)
+	assert.Equal(t, server.Object{"id": "1", "text": "alice's", "author": "key:alice"}, stored)
+
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/notes", url), `{"id": "1", "text": "edited"}`, "alice-key")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "posts replace objects the principal owns")
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/notes", url), `{"id": "1", "text": "moderated"}`, "moderator-key")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestServer_OwnersAreToldApartByKind(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	auth := noteKeys
+	auth.JWT = &server.JWTConfig{Keys: []string{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))}}
+	auth.Roles = map[string]server.Role{"writer": {Permissions: map[string][]server.Scope{"notes": {server.ScopeRead, server.ScopeWrite}}}}
+	url := startConfiguredServer(t, storeWith(t, notes...), []server.Type{NotesType}, withAuth(auth))
+
+	c := claims("writer")
+	c["sub"] = "alice"
+	token := signToken(t, jwt.SigningMethodES256, "", key, c)
+	assert.Equal(t, http.StatusNotFound, bearerRequest(t, http.MethodGet, fmt.Sprintf("%s/notes/1", url), token), "the key alice owns the note")
+
+	request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/notes", url), strings.NewReader(`{"id": "4", "text": "from a token"}`))
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.JSONEq(t, `{"id": "4", "text": "from a token", "author": "jwt:alice"}`, readBody(t, resp))
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/notes/4", url), "", "alice-key")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
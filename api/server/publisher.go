@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// publishAttempts is how often publishing an event is tried before it is dropped.
+const publishAttempts = 5
+
+// Publisher sends change events to a message bus such as Google Pub/Sub, implementations must be safe to use
+// from several goroutines.
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+	// Close flushes events still being sent and releases the connection to the bus.
+	Close() error
+}
+
+// RunPublishers sends every event to each of Config.Publishers until the context is done, then closes them. Each
+// instance publishes the events of the writes it handles, with the outbox on RunOutbox publishes them instead.
+func (s *Server) RunPublishers(ctx context.Context) {
+	if len(s.Config.Publishers) == 0 {
+		return
+	}
+	defer func() {
+		for _, p := range s.Config.Publishers {
+			if err := p.Close(); err != nil {
+				log.Printf("Error closing publisher %T: %s \n", p, err)
+			}
+		}
+	}()
+
+	if s.Config.Outbox {
+		// RunOutbox publishes the events
+		<-ctx.Done()
+		return
+	}
+	s.follow(ctx, "publishers", func(e Event) {
+		s.publishEvent(ctx, e)
+	})
+}
+
+// publishEvent sends an event to every publisher, retrying with backoff when the bus is unavailable.
+func (s Server) publishEvent(ctx context.Context, e Event) {
+	for _, p := range s.Config.Publishers {
+		backoff := 100 * time.Millisecond
+		for attempt := 1; ; attempt++ {
+			err := p.Publish(ctx, e)
+			if err == nil {
+				break
+			}
+			if attempt == publishAttempts || ctx.Err() != nil {
+				log.Printf("Dropping event %d, publisher %T failed: %s \n", e.Id, p, err)
+				break
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package server_test
+
+import (
+	"context"
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyPublisher fails the first publishes it gets, then records the events, taking delay over each.
+type flakyPublisher struct {
+	lock     *sync.Mutex
+	failures int
+	delay    time.Duration
+	events   []server.Event
+	closed   bool
+}
+
+func (p *flakyPublisher) Publish(_ context.Context, e server.Event) error {
+	time.Sleep(p.delay)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("bus unavailable")
+	}
+	p.events = append(p.events, e)
+	return nil
+}
+
+func (p *flakyPublisher) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *flakyPublisher) published() ([]server.Event, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]server.Event{}, p.events...), p.closed
+}
+
+func TestServer_PublishersReceiveEveryChange(t *testing.T) {
+	bus := &flakyPublisher{lock: &sync.Mutex{}, failures: 2}
+
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	r := chi.NewRouter()
+	s, err := server.New(server.Config{
+		Types:      []server.Type{BasicType},
+		Publishers: []server.Publisher{bus},
+	}, store)
+	require.NoError(t, err)
+	require.NoError(t, s.Start(r))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stopped := make(chan struct{})
+	go func() {
+		s.RunPublishers(ctx)
+		close(stopped)
+	}()
+	testServer := httptest.NewServer(r)
+	t.Cleanup(testServer.Close)
+	url := testServer.URL + "/api"
+
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "1", "name": "chris"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/user/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	require.Eventually(t, func() bool {
+		events, _ := bus.published()
+		return len(events) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	events, _ := bus.published()
+	assert.Equal(t, server.OpCreate, events[0].Operation)
+	assert.Equal(t, server.Object{"id": "1", "name": "chris"}, events[0].Object)
+	assert.Equal(t, server.OpDelete, events[1].Operation)
+	assert.Equal(t, "1", events[1].ObjectId)
+
+	cancel()
+	<-stopped
+	_, closed := bus.published()
+	assert.True(t, closed)
+}
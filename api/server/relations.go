@@ -0,0 +1,342 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// OnDelete controls what happens to referencing objects when the object they reference is deleted.
+type OnDelete string
+
+const (
+	OnDeleteRestrict OnDelete = "restrict"
+	OnDeleteCascade  OnDelete = "cascade"
+	OnDeleteSetNull  OnDelete = "setNull"
+)
+
+// Relation is a property holding the id of an object of another type, declared in the schema with
+// "x-ref": "<type>" and optionally "x-on-delete": "restrict" | "cascade" | "setNull".
+type Relation struct {
+	Field    string
+	Type     string
+	OnDelete OnDelete
+}
+
+// Relations parses the relations declared on the top level properties of the type schema.
+func (t Type) Relations() ([]Relation, error) {
+	var schema struct {
+		Properties map[string]struct {
+			Ref      string   `json:"x-ref"`
+			OnDelete OnDelete `json:"x-on-delete"`
+		} `json:"properties"`
+	}
+	err := json.Unmarshal([]byte(t.Schema), &schema)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse schema for type %s: %w", t.Name, err)
+	}
+
+	relations := make([]Relation, 0)
+	for field, property := range schema.Properties {
+		if property.Ref == "" {
+			continue
+		}
+		onDelete := property.OnDelete
+		switch onDelete {
+		case "":
+			onDelete = OnDeleteRestrict
+		case OnDeleteRestrict, OnDeleteCascade, OnDeleteSetNull:
+		default:
+			return nil, fmt.Errorf("invalid x-on-delete %s for %s.%s", onDelete, t.Name, field)
+		}
+		relations = append(relations, Relation{Field: field, Type: property.Ref, OnDelete: onDelete})
+	}
+	sort.Slice(relations, func(i, j int) bool {
+		return relations[i].Field < relations[j].Field
+	})
+	return relations, nil
+}
+
+type inboundRelation struct {
+	Source   Type
+	Relation Relation
+}
+
+// loadRelations parses the relations of every type and checks that they point at known types.
+func loadRelations(types []Type) (map[string][]Relation, error) {
+	relations := map[string][]Relation{}
+	for _, t := range types {
+		rs, err := t.Relations()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rs {
+			if typeByName(types, r.Type) == nil {
+				return nil, fmt.Errorf("%s.%s references unknown type %s", t.Name, r.Field, r.Type)
+			}
+		}
+		relations[t.Name] = rs
+	}
+	return relations, nil
+}
+
+func typeByName(types []Type, name string) *Type {
+	for _, t := range types {
+		if t.Name == name {
+			return &t
+		}
+	}
+	return nil
+}
+
+// inbound lists the relations of other types that point at the named type.
+func (s Server) inbound(name string) []inboundRelation {
+	inbound := make([]inboundRelation, 0)
+	for _, t := range s.Config.Types {
+		for _, r := range s.relations[t.Name] {
+			if r.Type == name {
+				inbound = append(inbound, inboundRelation{Source: t, Relation: r})
+			}
+		}
+	}
+	return inbound
+}
+
+// checkReferences returns a validation error for every relation of obj pointing at an object that doesn't exist.
+func (s Server) checkReferences(t Type, obj Object) ([]string, error) {
+	errs := make([]string, 0)
+	for _, r := range s.relations[t.Name] {
+		value, present := obj[r.Field]
+		if !present || value == nil {
+			continue
+		}
+		ref, err := idToString(value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: reference must be a string or integer id", r.Field))
+			continue
+		}
+
+		_, err = s.DataStore.Get(*typeByName(s.Config.Types, r.Type), ref)
+		if errors.Is(err, ErrNotFound) {
+			errs = append(errs, fmt.Sprintf("%s: no %s found with id %s", r.Field, r.Type, ref))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to check reference %s.%s: %w", t.Name, r.Field, err)
+		}
+	}
+	return errs, nil
+}
+
+// referencedBy lists the objects of type source that reference the object id of type target.
+func (s Server) referencedBy(target Type, id string, source Type) ([]Object, error) {
+	referencing := make([]Object, 0)
+	seen := map[string]bool{}
+	for _, in := range s.inbound(target.Name) {
+		if in.Source.Name != source.Name {
+			continue
+		}
+		found, err := s.find(source, in.Relation.Field, id)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find %s referencing %s %s: %w", source.Name, target.Name, id, err)
+		}
+		for _, obj := range found {
+			key, _ := IndexValue(obj[source.Id])
+			if !seen[key] {
+				seen[key] = true
+				referencing = append(referencing, obj)
+			}
+		}
+	}
+	return referencing, nil
+}
+
+// referencingTypes lists the types with a relation to t, each once.
+func (s Server) referencingTypes(t Type) []Type {
+	types := make([]Type, 0)
+	for _, in := range s.inbound(t.Name) {
+		if typeByName(types, in.Source.Name) == nil {
+			types = append(types, in.Source)
+		}
+	}
+	return types
+}
+
+type objectRef struct {
+	Type Type
+	Id   string
+}
+
+func (o objectRef) key() string {
+	return o.Type.Name + "/" + o.Id
+}
+
+type nullification struct {
+	Object objectRef
+	Field  string
+}
+
+type deletePlan struct {
+	deleting map[string]bool
+	deletes  []objectRef
+	nulls    []nullification
+}
+
+// delete removes an object applying the x-on-delete behaviour of every relation pointing at it.
+// All referencing objects are checked before anything is changed, so a restricted delete changes nothing.
+// Cascaded deletes of SoftDelete types move the referencing objects to the trash. Every referencing object
+// deleted or changed is audited, the caller audits the delete of the object itself.
+func (s Server) delete(ctx context.Context, t Type, id string) error {
+	plan := &deletePlan{deleting: map[string]bool{}}
+	err := s.planDelete(objectRef{Type: t, Id: id}, plan)
+	if err != nil {
+		return err
+	}
+	err = s.authorizePlan(ctx, plan)
+	if err != nil {
+		return err
+	}
+
+	cleared, err := s.clearReferences(plan)
+	if err != nil {
+		return err
+	}
+	for i, n := range plan.nulls {
+		if cleared[i] == nil {
+			continue
+		}
+		err = s.update(n.Object.Type, n.Object.Id, cleared[i].after)
+		if err != nil {
+			return fmt.Errorf("unable to clear reference %s.%s on %s: %w", n.Object.Type.Name, n.Field, n.Object.Id, err)
+		}
+		s.audit(ctx, n.Object.Type, n.Object.Id, OpUpdate, cleared[i].before, cleared[i].after)
+	}
+
+	principal, _ := PrincipalFrom(ctx)
+	for _, d := range plan.deletes {
+		cascaded := d.Type.Name != t.Name || d.Id != id
+		var before Object
+		if cascaded {
+			before = s.auditBefore(d.Type, d.Id, StageDraft)
+		}
+		if cascaded && d.Type.SoftDelete {
+			err := s.trash(d.Type, d.Id, principal.Name)
+			if err != nil {
+				return err
+			}
+		}
+		err := s.remove(d.Type, d.Id)
+		if err != nil {
+			return fmt.Errorf("unable to delete %s %s: %w", d.Type.Name, d.Id, err)
+		}
+		if cascaded {
+			s.audit(ctx, d.Type, d.Id, OpDelete, before, nil)
+		}
+	}
+	return nil
+}
+
+type clearedReference struct {
+	before Object
+	after  Object
+}
+
+// clearReferences returns the objects whose references a delete sets to null, before and after, in the order of the
+// plan and nil for the objects it deletes. The cleared objects are checked against the schema of their type, a
+// relation whose field can't be null can't be cleared.
+func (s Server) clearReferences(plan *deletePlan) ([]*clearedReference, error) {
+	cleared := make([]*clearedReference, len(plan.nulls))
+	for i, n := range plan.nulls {
+		if plan.deleting[n.Object.key()] {
+			continue
+		}
+		before, err := s.DataStore.Get(n.Object.Type, n.Object.Id)
+		if err != nil {
+			return nil, fmt.Errorf("unable to clear reference %s.%s on %s: %w", n.Object.Type.Name, n.Field, n.Object.Id, err)
+		}
+		// providers may return the object they hold, it is changed on a copy
+		after := copyObject(before)
+		after[n.Field] = nil
+
+		content, err := json.Marshal(after)
+		if err != nil {
+			return nil, err
+		}
+		valid, messages, err := s.validators[n.Object.Type.Name].Validate(string(content))
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, fmt.Errorf("%w: clearing %s.%s on %s makes it invalid: %s", ErrBadRequest, n.Object.Type.Name, n.Field, n.Object.Id, strings.Join(messages, ", "))
+		}
+		cleared[i] = &clearedReference{before: before, after: after}
+	}
+	return cleared, nil
+}
+
+// authorizePlan checks the principal can delete every object a delete cascades to, and write every object whose
+// reference it clears. Deletes the server makes itself, such as scheduled unpublishes, have no principal.
+func (s Server) authorizePlan(ctx context.Context, plan *deletePlan) error {
+	if _, ok := PrincipalFrom(ctx); !ok {
+		return nil
+	}
+	for _, d := range plan.deletes {
+		err := s.can(ctx, d.Type.Name, ScopeDelete)
+		if err != nil {
+			return err
+		}
+	}
+	for _, n := range plan.nulls {
+		if plan.deleting[n.Object.key()] {
+			continue
+		}
+		err := s.can(ctx, n.Object.Type.Name, ScopeWrite)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Server) planDelete(target objectRef, plan *deletePlan) error {
+	if plan.deleting[target.key()] {
+		return nil
+	}
+	plan.deleting[target.key()] = true
+
+	for _, in := range s.inbound(target.Type.Name) {
+		referencing, err := s.find(in.Source, in.Relation.Field, target.Id)
+		if err != nil {
+			return fmt.Errorf("unable to find %s referencing %s %s: %w", in.Source.Name, target.Type.Name, target.Id, err)
+		}
+
+		for _, obj := range referencing {
+			refId, err := idToString(obj[in.Source.Id])
+			if err != nil {
+				return fmt.Errorf("unable to read id of %s referencing %s %s: %w", in.Source.Name, target.Type.Name, target.Id, err)
+			}
+			ref := objectRef{Type: in.Source, Id: refId}
+			if plan.deleting[ref.key()] {
+				continue
+			}
+
+			switch in.Relation.OnDelete {
+			case OnDeleteCascade:
+				err = s.planDelete(ref, plan)
+				if err != nil {
+					return err
+				}
+			case OnDeleteSetNull:
+				plan.nulls = append(plan.nulls, nullification{Object: ref, Field: in.Relation.Field})
+			default:
+				return fmt.Errorf("%w: %s %s is referenced by %s %s", ErrConflict, target.Type.Name, target.Id, in.Source.Name, refId)
+			}
+		}
+	}
+
+	plan.deletes = append(plan.deletes, target)
+	return nil
+}
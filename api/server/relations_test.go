@@ -0,0 +1,212 @@
+package server_test
+
+import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var UsersType = server.Type{Name: "users", Id: "id", Schema:
+// language=json
+`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"name": { "type": "string" }
+	}
+}`}
+
+func petsType(onDelete server.OnDelete) server.Type {
+	return server.Type{Name: "pets", Id: "id", Schema: fmt.Sprintf(
+		// language=json
+		`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"owner": { "type": ["string", "null"], "x-ref": "users", "x-on-delete": "%s" }
+	}
+}`, onDelete)}
+}
+
+func TestType_Relations(t *testing.T) {
+	relations, err := petsType(server.OnDeleteCascade).Relations()
+	require.NoError(t, err)
+	assert.Equal(t, []server.Relation{{Field: "owner", Type: "users", OnDelete: server.OnDeleteCascade}}, relations)
+
+	_, err = petsType("sometimes").Relations()
+	assert.Error(t, err)
+}
+
+func TestServer_StartRejectsUnknownRelationType(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+
+	err = server.Server{
+		Config:    server.Config{Types: []server.Type{petsType(server.OnDeleteRestrict)}},
+		DataStore: store,
+	}.Start(nil)
+	assert.ErrorContains(t, err, "pets.owner references unknown type users")
+}
+
+func TestServer_PostValidatesReferences(t *testing.T) {
+	pets := petsType(server.OnDeleteRestrict)
+	store, err := datastore.NewMemory(datastore.Record{Type: UsersType, Id: "1", Data: server.Object{"id": "1", "name": "chris"}})
+	require.NoError(t, err)
+
+	url, closeFn := startServer(store, UsersType, pets)
+	defer closeFn()
+
+	resp, err := http.Post(fmt.Sprintf("%s/pets", url), "application/json", strings.NewReader(`{"id": "1", "owner": "2"}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"validationErrors": ["owner: no users found with id 2"]}`, string(body))
+
+	resp, err = http.Post(fmt.Sprintf("%s/pets", url), "application/json", strings.NewReader(`{"id": "1", "owner": "1"}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestServer_DeleteRestrictedByReference(t *testing.T) {
+	pets := petsType(server.OnDeleteRestrict)
+	store := storeWithPet(t, pets)
+
+	url, closeFn := startServer(store, UsersType, pets)
+	defer closeFn()
+
+	resp := deleteRequest(t, fmt.Sprintf("%s/users/1", url))
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	_, err := store.Get(UsersType, "1")
+	assert.NoError(t, err)
+}
+
+func TestServer_DeleteCascadesToReferences(t *testing.T) {
+	pets := petsType(server.OnDeleteCascade)
+	store := storeWithPet(t, pets)
+
+	url, closeFn := startServer(store, UsersType, pets)
+	defer closeFn()
+
+	resp := deleteRequest(t, fmt.Sprintf("%s/users/1", url))
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	_, err := store.Get(pets, "1")
+	assert.ErrorIs(t, err, server.ErrNotFound)
+	_, err = store.Get(UsersType, "1")
+	assert.ErrorIs(t, err, server.ErrNotFound)
+}
+
+func TestServer_DeleteSetsReferencesNull(t *testing.T) {
+	pets := petsType(server.OnDeleteSetNull)
+	store := storeWithPet(t, pets)
+
+	url, closeFn := startServer(store, UsersType, pets)
+	defer closeFn()
+
+	resp := deleteRequest(t, fmt.Sprintf("%s/users/1", url))
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	pet, err := store.Get(pets, "1")
+	require.NoError(t, err)
+	assert.Nil(t, pet["owner"])
+	found, err := store.Find(pets, "owner", "1")
+	require.NoError(t, err)
+	assert.Empty(t, found, "the index no longer holds the pet under its old owner")
+}
+
+func TestServer_DeleteRejectsSettingRequiredReferencesNull(t *testing.T) {
+	pets := server.Type{Name: "pets", Id: "id", Schema:
+	// language=json
+	`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"owner": { "type": "string", "x-ref": "users", "x-on-delete": "setNull" }
+	}
+}`}
+	store := storeWithPet(t, pets)
+	url := startConfiguredServer(t, store, []server.Type{UsersType, pets})
+
+	resp := deleteRequest(t, fmt.Sprintf("%s/users/1", url))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, err := store.Get(UsersType, "1")
+	assert.NoError(t, err)
+	pet, err := store.Get(pets, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "1", pet["owner"])
+}
+
+func storeWithPet(t *testing.T, pets server.Type) datastore.Memory {
+	store, err := datastore.NewMemory(
+		datastore.Record{Type: UsersType, Id: "1", Data: server.Object{"id": "1", "name": "chris"}},
+		datastore.Record{Type: pets, Id: "1", Data: server.Object{"id": "1", "owner": "1"}},
+	)
+	require.NoError(t, err)
+	return store
+}
+
+func deleteRequest(t *testing.T, url string) *http.Response {
+	request, err := http.NewRequest(http.MethodDelete, url, nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestServer_ListsReverseRelations(t *testing.T) {
+	pets := petsType(server.OnDeleteRestrict)
+	store, err := datastore.NewMemory(
+		datastore.Record{Type: UsersType, Id: "1", Data: server.Object{"id": "1", "name": "chris"}},
+		datastore.Record{Type: UsersType, Id: "2", Data: server.Object{"id": "2", "name": "fred"}},
+		datastore.Record{Type: pets, Id: "1", Data: server.Object{"id": "1", "owner": "1"}},
+		datastore.Record{Type: pets, Id: "2", Data: server.Object{"id": "2", "owner": "2"}},
+		datastore.Record{Type: pets, Id: "3", Data: server.Object{"id": "3", "owner": "1"}},
+	)
+	require.NoError(t, err)
+
+	url, closeFn := startServer(store, UsersType, pets)
+	defer closeFn()
+
+	body := getBody(t, fmt.Sprintf("%s/users/1/pets", url), http.StatusOK)
+	assert.JSONEq(t, `[{"id": "1", "owner": "1"}, {"id": "3", "owner": "1"}]`, body)
+
+	body = getBody(t, fmt.Sprintf("%s/users/2/pets?expand=owner", url), http.StatusOK)
+	assert.JSONEq(t, `[{"id": "2", "owner": {"id": "2", "name": "fred"}}]`, body)
+
+	getBody(t, fmt.Sprintf("%s/users/3/pets", url), http.StatusNotFound)
+}
+
+func TestServer_DeleteNeedsPermissionOnReferencingTypes(t *testing.T) {
+	keys := server.AuthConfig{APIKeys: append([]server.APIKey{
+		{Name: "users-admin", Hash: server.HashKey("users-key"), Permissions: map[string][]server.Scope{"users": {server.ScopeRead, server.ScopeDelete}}},
+	}, apiKeys.APIKeys...)}
+	for _, onDelete := range []server.OnDelete{server.OnDeleteCascade, server.OnDeleteSetNull} {
+		t.Run(string(onDelete), func(t *testing.T) {
+			pets := petsType(onDelete)
+			store := storeWithPet(t, pets)
+			url := startConfiguredServer(t, store, []server.Type{UsersType, pets}, withAuth(keys))
+
+			resp := authRequest(t, http.MethodDelete, fmt.Sprintf("%s/users/1", url), "", "users-key")
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			_, err := store.Get(UsersType, "1")
+			assert.NoError(t, err)
+			pet, err := store.Get(pets, "1")
+			require.NoError(t, err)
+			assert.Equal(t, "1", pet["owner"])
+
+			resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/users/1", url), "", "admin-key")
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Role grants permissions to the principals holding it.
+type Role struct {
+	// Permissions are the scopes granted on each type name, or on every type with AnyType.
+	Permissions map[string][]Scope
+	// Fields restricts the fields of each type name, or of every type with AnyType, the role can see and change.
+	Fields map[string]FieldRules
+}
+
+// FieldRules mask fields of a type from a role.
+type FieldRules struct {
+	// Hidden fields are removed from the objects the role reads and can't be written by it.
+	Hidden []string
+	// Protected fields can be read but not written by the role.
+	Protected []string
+}
+
+func (r Role) can(typeName string, scope Scope) bool {
+	for _, name := range []string{typeName, AnyType} {
+		for _, granted := range r.Permissions[name] {
+			if granted == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newPrincipal grants the principal the permissions given to it directly and those of each of its roles.
+func newPrincipal(kind string, name string, permissions map[string][]Scope, roles map[string]Role, roleNames []string) Principal {
+	principal := Principal{Name: name, Kind: kind, Roles: roleNames, Permissions: map[string][]Scope{}}
+	grants := make([]Role, 0)
+	if len(permissions) > 0 {
+		grants = append(grants, Role{Permissions: permissions})
+	}
+	for _, roleName := range roleNames {
+		if role, found := roles[roleName]; found {
+			grants = append(grants, role)
+		}
+	}
+	for _, grant := range grants {
+		for typeName, scopes := range grant.Permissions {
+			principal.Permissions[typeName] = append(principal.Permissions[typeName], scopes...)
+		}
+	}
+	principal.grants = grants
+	return principal
+}
+
+// HiddenFields lists the fields of the type the principal can't read. A field is only hidden when every grant
+// allowing the principal to read the type hides it.
+func (p Principal) HiddenFields(typeName string) []string {
+	return p.masked(typeName, ScopeRead, func(rules FieldRules) []string {
+		return rules.Hidden
+	})
+}
+
+// ProtectedFields lists the fields of the type the principal can't write, including those it can't read.
+func (p Principal) ProtectedFields(typeName string) []string {
+	return p.masked(typeName, ScopeWrite, func(rules FieldRules) []string {
+		return append(append([]string{}, rules.Hidden...), rules.Protected...)
+	})
+}
+
+func (p Principal) masked(typeName string, scope Scope, fields func(FieldRules) []string) []string {
+	masked := make([]string, 0)
+	first := true
+	for _, grant := range p.grants {
+		if !grant.can(typeName, scope) {
+			continue
+		}
+		grantMasked := append(append([]string{}, fields(grant.Fields[typeName])...), fields(grant.Fields[AnyType])...)
+		if first {
+			masked = grantMasked
+			first = false
+			continue
+		}
+		intersection := make([]string, 0)
+		for _, field := range masked {
+			if contains(grantMasked, field) {
+				intersection = append(intersection, field)
+			}
+		}
+		masked = intersection
+	}
+
+	unique := make([]string, 0, len(masked))
+	for _, field := range masked {
+		if !contains(unique, field) {
+			unique = append(unique, field)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+func (s Server) hiddenFields(ctx context.Context, t Type) []string {
+	if !s.authEnabled() {
+		return []string{}
+	}
+	principal, _ := PrincipalFrom(ctx)
+	return principal.HiddenFields(t.Name)
+}
+
+// hide removes the fields the principal can't read from objs, and from the objects expanded into them.
+// Expanded objects the principal doesn't own are replaced by their ids again.
+func (s Server) hide(ctx context.Context, t Type, objs []Object, tree expansion) {
+	hidden := s.hiddenFields(ctx, t)
+	for _, obj := range objs {
+		for _, field := range hidden {
+			delete(obj, field)
+		}
+	}
+	for field, children := range tree {
+		relation := s.relation(t, field)
+		if relation == nil || contains(hidden, field) {
+			continue
+		}
+		target := *typeByName(s.Config.Types, relation.Type)
+		expanded := make([]Object, 0)
+		for _, obj := range objs {
+			ref, ok := obj[field].(Object)
+			if !ok {
+				continue
+			}
+			if !s.owns(ctx, target, ref) {
+				obj[field] = ref[target.Id]
+				continue
+			}
+			expanded = append(expanded, ref)
+		}
+		s.hide(ctx, target, expanded, children)
+	}
+}
+
+// authorizeFields rejects requests filtering or aggregating on fields the principal can't read.
+func (s Server) authorizeFields(ctx context.Context, t Type, fields []string) error {
+	hidden := s.hiddenFields(ctx, t)
+	forbidden := make([]string, 0)
+	for _, field := range fields {
+		if contains(hidden, field) && !contains(forbidden, field) {
+			forbidden = append(forbidden, field)
+		}
+	}
+	if len(forbidden) > 0 {
+		principal, _ := PrincipalFrom(ctx)
+		return fmt.Errorf("%w: %s can't read %s of %s", ErrForbidden, principal.Name, strings.Join(forbidden, ", "), t.Name)
+	}
+	return nil
+}
+
+// authorizeWrite rejects writes that set or change fields the principal can't write, id is empty for creates.
+// As clients can't send back fields they can't read, those left out of an update keep their stored values,
+// which are added to obj and reported by restored.
+func (s Server) authorizeWrite(ctx context.Context, t Type, id string, obj Object) (restored bool, err error) {
+	if !s.authEnabled() {
+		return false, nil
+	}
+	principal, _ := PrincipalFrom(ctx)
+	protected := principal.ProtectedFields(t.Name)
+	if len(protected) == 0 {
+		return false, nil
+	}
+
+	stored := Object{}
+	if id != "" {
+		existing, err := s.getStage(t, id, StageDraft)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		if err == nil {
+			stored = existing
+		}
+	}
+
+	forbidden := make([]string, 0)
+	for _, field := range protected {
+		value, sent := obj[field]
+		previous, existed := stored[field]
+		switch {
+		case !sent && existed:
+			obj[field] = previous
+			restored = true
+		case sent && (!existed || !reflect.DeepEqual(value, previous)):
+			forbidden = append(forbidden, field)
+		}
+	}
+	if len(forbidden) > 0 {
+		return false, fmt.Errorf("%w: %s can't write %s of %s", ErrForbidden, principal.Name, strings.Join(forbidden, ", "), t.Name)
+	}
+	return restored, nil
+}
@@ -0,0 +1,118 @@
+package server_test
+
+import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"testing"
+)
+
+var MembersType = server.Type{Name: "members", Id: "id", Search: []string{"name", "email"}, Schema:
+// language=json
+`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"required": ["id", "name", "role"],
+	"properties": {
+		"id": { "type": "string" },
+		"name": { "type": "string" },
+		"email": { "type": "string" },
+		"role": { "type": "string" }
+	}
+}`}
+
+var memberRoles = map[string]server.Role{
+	"public": {
+		Permissions: map[string][]server.Scope{"members": {server.ScopeRead}},
+		Fields:      map[string]server.FieldRules{"members": {Hidden: []string{"email"}}},
+	},
+	"editor": {
+		Permissions: map[string][]server.Scope{"members": {server.ScopeRead, server.ScopeWrite}},
+		Fields:      map[string]server.FieldRules{"members": {Protected: []string{"role"}}},
+	},
+	"admin": {
+		Permissions: map[string][]server.Scope{server.AnyType: {server.ScopeRead, server.ScopeWrite, server.ScopeDelete}},
+	},
+}
+
+var memberKeys = server.AuthConfig{
+	APIKeys: []server.APIKey{
+		{Name: "website", Hash: server.HashKey("public-key"), Roles: []string{"public"}},
+		{Name: "cms", Hash: server.HashKey("editor-key"), Roles: []string{"editor"}},
+		{Name: "ops", Hash: server.HashKey("admin-key"), Roles: []string{"admin"}},
+		{Name: "both", Hash: server.HashKey("both-key"), Roles: []string{"public", "editor"}},
+	},
+	Roles: memberRoles,
+}
+
+var owner = datastore.Record{Type: MembersType, Id: "1", Data: server.Object{"id": "1", "name": "chris", "email": "chris@example.com", "role": "owner"}}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestServer_HidesFieldsFromRoles(t *testing.T) {
+	url := startConfiguredServer(t, storeWith(t, owner), []server.Type{MembersType}, withAuth(memberKeys))
+
+	resp := authRequest(t, http.MethodGet, fmt.Sprintf("%s/members/1", url), "", "public-key")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"id": "1", "name": "chris", "role": "owner"}`, readBody(t, resp))
+
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/members", url), "", "public-key")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[{"id": "1", "name": "chris", "role": "owner"}]`, readBody(t, resp))
+
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/members?email=chris@example.com", url), "", "public-key")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.JSONEq(t, `{"message": "forbidden: website can't read email of members"}`, readBody(t, resp))
+
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/members/1", url), "", "both-key")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"id": "1", "name": "chris", "email": "chris@example.com", "role": "owner"}`, readBody(t, resp))
+}
+
+func TestServer_SearchSkipsFieldsHiddenFromRoles(t *testing.T) {
+	url := startConfiguredServer(t, storeWith(t, owner), []server.Type{MembersType}, withAuth(memberKeys))
+
+	resp := authRequest(t, http.MethodGet, fmt.Sprintf("%s/members/_search?q=example", url), "", "public-key")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[]`, readBody(t, resp))
+
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/members/_search?q=chris", url), "", "public-key")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[{"id": "1", "name": "chris", "role": "owner"}]`, readBody(t, resp))
+
+	resp = authRequest(t, http.MethodGet, fmt.Sprintf("%s/members/_search?q=example", url), "", "admin-key")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[{"id": "1", "name": "chris", "email": "chris@example.com", "role": "owner"}]`, readBody(t, resp))
+}
+
+func TestServer_RejectsWritesToProtectedFields(t *testing.T) {
+	store := storeWith(t, owner)
+	url := startConfiguredServer(t, store, []server.Type{MembersType}, withAuth(memberKeys))
+
+	resp := authRequest(t, http.MethodPut, fmt.Sprintf("%s/members/1", url), `{"id": "1", "name": "chris", "role": "admin"}`, "editor-key")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.JSONEq(t, `{"message": "forbidden: cms can't write role of members"}`, readBody(t, resp))
+
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/members", url), `{"id": "2", "name": "fred", "role": "admin"}`, "editor-key")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/members/1", url), `{"id": "1", "name": "Chris", "email": "chris@example.com", "role": "owner"}`, "editor-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/members/1", url), `{"id": "1", "name": "Christopher"}`, "editor-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	stored, err := store.Get(MembersType, "1")
+	require.NoError(t, err)
+	assert.Equal(t, server.Object{"id": "1", "name": "Christopher", "role": "owner"}, stored)
+
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/members/1", url), `{"id": "1", "name": "chris", "role": "admin"}`, "admin-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// DefaultScheduleInterval is how often due schedules are applied when Config.ScheduleInterval isn't set.
+const DefaultScheduleInterval = 30 * time.Second
+
+// schedulerLease is held by the instance applying schedules, so scaled instances don't apply them twice.
+const schedulerLease = "scheduler"
+
+// Schedule publishes the draft of an object at PublishAt and unpublishes it at UnpublishAt. A change that fails is
+// kept and retried every interval, LastError tells why it failed.
+type Schedule struct {
+	Type        string     `json:"type"`
+	Id          string     `json:"id"`
+	PublishAt   *time.Time `json:"publishAt,omitempty"`
+	UnpublishAt *time.Time `json:"unpublishAt,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// schedulesType is where schedules are stored, one per object.
+var schedulesType = Type{Name: "_schedules", Id: "key", Schema: `{"type": "object"}`}
+
+func scheduleKey(t Type, id string) string {
+	return url.PathEscape(t.Name) + "." + url.PathEscape(id)
+}
+
+// next is when the schedule is next due.
+func (sc Schedule) next() time.Time {
+	if sc.PublishAt != nil && (sc.UnpublishAt == nil || sc.PublishAt.Before(*sc.UnpublishAt)) {
+		return *sc.PublishAt
+	}
+	if sc.UnpublishAt != nil {
+		return *sc.UnpublishAt
+	}
+	return time.Time{}
+}
+
+func (sc Schedule) validate() error {
+	if sc.PublishAt == nil && sc.UnpublishAt == nil {
+		return fmt.Errorf("%w: a schedule needs publishAt or unpublishAt", ErrBadRequest)
+	}
+	if sc.PublishAt != nil && sc.UnpublishAt != nil && !sc.UnpublishAt.After(*sc.PublishAt) {
+		return fmt.Errorf("%w: unpublishAt must be after publishAt", ErrBadRequest)
+	}
+	return nil
+}
+
+func scheduleFromObject(obj Object) (Schedule, error) {
+	var sc Schedule
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return sc, err
+	}
+	err = json.Unmarshal(b, &sc)
+	return sc, err
+}
+
+func (sc Schedule) object(key string) (Object, error) {
+	var obj Object
+	b, err := json.Marshal(sc)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &obj)
+	obj[schedulesType.Id] = key
+	return obj, err
+}
+
+func (s Server) getSchedule(t Type, id string) (Schedule, error) {
+	obj, err := s.DataStore.Get(schedulesType, scheduleKey(t, id))
+	if err != nil {
+		return Schedule{}, fmt.Errorf("no schedule for %s %s: %w", t.Name, id, err)
+	}
+	return scheduleFromObject(obj)
+}
+
+func (s Server) putSchedule(t Type, id string, sc Schedule) error {
+	sc.Type = t.Name
+	sc.Id = id
+	key := scheduleKey(t, id)
+	obj, err := sc.object(key)
+	if err != nil {
+		return err
+	}
+	return s.DataStore.Update(schedulesType, key, obj)
+}
+
+// removeSchedule deletes the schedule of an object when there is one.
+func (s Server) removeSchedule(t Type, id string) error {
+	if !t.hasDrafts() {
+		return nil
+	}
+	_, err := s.DataStore.Get(schedulesType, scheduleKey(t, id))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.DataStore.Delete(schedulesType, scheduleKey(t, id))
+}
+
+// schedules lists the pending schedules, soonest first.
+func (s Server) schedules() ([]Schedule, error) {
+	objs, err := s.DataStore.List(schedulesType)
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]Schedule, 0, len(objs))
+	for _, obj := range objs {
+		sc, err := scheduleFromObject(obj)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read schedule %v: %w", obj[schedulesType.Id], err)
+		}
+		schedules = append(schedules, sc)
+	}
+	sort.SliceStable(schedules, func(i, j int) bool {
+		return schedules[i].next().Before(schedules[j].next())
+	})
+	return schedules, nil
+}
+
+// RunScheduler applies due schedules every Config.ScheduleInterval until the context is done. It must be run after
+// Start, on every instance: when the provider is a Leaser only the instance holding the lease applies them.
+func (s *Server) RunScheduler(ctx context.Context) {
+	hasDrafts := false
+	for _, t := range s.Config.Types {
+		hasDrafts = hasDrafts || t.hasDrafts()
+	}
+	if !hasDrafts {
+		return
+	}
+	interval := s.Config.ScheduleInterval
+	if interval == 0 {
+		interval = DefaultScheduleInterval
+	}
+	s.runLeased(ctx, schedulerLease, interval, 0, s.applySchedules)
+}
+
+func (s Server) applySchedules(now time.Time, renew func() bool) error {
+	schedules, err := s.schedules()
+	if err != nil {
+		return err
+	}
+	for _, sc := range schedules {
+		t := typeByName(s.Config.Types, sc.Type)
+		if t == nil || !t.hasDrafts() {
+			log.Printf("Dropping schedule of unknown type %s \n", sc.Type)
+			err = s.DataStore.Delete(schedulesType, scheduleKey(Type{Name: sc.Type}, sc.Id))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !sc.due(now) {
+			continue
+		}
+		if !renew() {
+			return nil
+		}
+
+		// failed changes stay scheduled to be retried, an unpublish waits until the publish before it has been made
+		lastError := sc.LastError
+		sc.LastError = ""
+		changed := false
+		if sc.PublishAt != nil && !sc.PublishAt.After(now) {
+			if err := s.publishScheduled(*t, sc.Id); err != nil {
+				log.Printf("Error publishing %s %s: %s \n", t.Name, sc.Id, err)
+				sc.LastError = fmt.Sprintf("unable to publish: %s", err)
+			} else {
+				sc.PublishAt = nil
+				changed = true
+			}
+		}
+		if sc.UnpublishAt != nil && !sc.UnpublishAt.After(now) && sc.PublishAt == nil {
+			if err := s.unpublish(*t, sc.Id); err != nil {
+				log.Printf("Error unpublishing %s %s: %s \n", t.Name, sc.Id, err)
+				sc.LastError = fmt.Sprintf("unable to unpublish: %s", err)
+			} else {
+				sc.UnpublishAt = nil
+				changed = true
+			}
+		}
+		changed = changed || sc.LastError != lastError
+
+		switch {
+		case sc.PublishAt == nil && sc.UnpublishAt == nil:
+			err = s.DataStore.Delete(schedulesType, scheduleKey(*t, sc.Id))
+		case changed:
+			err = s.putSchedule(*t, sc.Id, sc)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc Schedule) due(now time.Time) bool {
+	return sc.PublishAt != nil && !sc.PublishAt.After(now) || sc.UnpublishAt != nil && !sc.UnpublishAt.After(now)
+}
+
+// publishScheduled publishes the draft of an object, if it still has one.
+func (s Server) publishScheduled(t Type, id string) error {
+	draft, err := s.DataStore.Get(t.draftType(), id)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	referenceErrors, err := s.checkReferences(t, draft)
+	if err != nil {
+		return err
+	}
+	if len(referenceErrors) > 0 {
+		return fmt.Errorf("%w: %v", ErrConflict, referenceErrors)
+	}
+	_, err = s.publish(t, id)
+	return err
+}
+
+// unpublish takes an object offline, keeping it as a draft unless it already has one.
+func (s Server) unpublish(t Type, id string) error {
+	published, err := s.DataStore.Get(t, id)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.DataStore.Get(t.draftType(), id)
+	if errors.Is(err, ErrNotFound) {
+		err = s.create(t.draftType(), id, published)
+	}
+	if err != nil {
+		return err
+	}
+	// unpublished by the scheduler, there is no principal to audit the cascades under
+	return s.delete(context.Background(), t, id)
+}
+
+func (s Server) addScheduleEndpoints(r chi.Router, t Type) {
+	path := fmt.Sprintf("/%s/{id}/_schedule", t.Name)
+
+	r.With(s.authorize(ScopeRead, t.Name)).Get(path, func(writer http.ResponseWriter, request *http.Request) {
+		id := chi.URLParam(request, "id")
+		_, err := s.getOwned(request.Context(), t, id, StageDraft)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		sc, err := s.getSchedule(t, id)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		writeJSON(writer, sc)
+	})
+
+	r.With(s.authorize(ScopePublish, t.Name)).Put(path, func(writer http.ResponseWriter, request *http.Request) {
+		id := chi.URLParam(request, "id")
+		_, err := s.getOwned(request.Context(), t, id, StageDraft)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+
+		var sc Schedule
+		err = json.NewDecoder(request.Body).Decode(&sc)
+		if err != nil {
+			handleError(writer, fmt.Errorf("%w: invalid schedule: %s", ErrBadRequest, err))
+			return
+		}
+		sc.LastError = ""
+		err = sc.validate()
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		err = s.putSchedule(t, id, sc)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		sc.Type = t.Name
+		sc.Id = id
+		writeJSON(writer, sc)
+	})
+
+	r.With(s.authorize(ScopePublish, t.Name)).Delete(path, func(writer http.ResponseWriter, request *http.Request) {
+		id := chi.URLParam(request, "id")
+		_, err := s.getOwned(request.Context(), t, id, StageDraft)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		_, err = s.getSchedule(t, id)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		err = s.removeSchedule(t, id)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// listSchedules serves the pending schedules of the objects the principal can read, soonest first.
+func (s Server) listSchedules(writer http.ResponseWriter, request *http.Request) {
+	schedules, err := s.schedules()
+	if err != nil {
+		handleError(writer, err)
+		return
+	}
+
+	readable := make([]Schedule, 0, len(schedules))
+	for _, sc := range schedules {
+		t := typeByName(s.Config.Types, sc.Type)
+		if t == nil || s.can(request.Context(), t.Name, ScopeRead) != nil {
+			continue
+		}
+		if _, restricted := s.ownedBy(request.Context(), *t); restricted {
+			if _, err := s.getOwned(request.Context(), *t, sc.Id, StageDraft); err != nil {
+				continue
+			}
+		}
+		readable = append(readable, sc)
+	}
+
+	writer.Header().Set("X-Total-Count", fmt.Sprintf("%d", len(readable)))
+	writeJSON(writer, readable)
+}
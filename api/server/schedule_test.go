@@ -0,0 +1,125 @@
+package server_test
+
+import (
+	"context"
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startScheduler(t *testing.T, store datastore.Memory, types ...server.Type) (string, func()) {
+	r := chi.NewRouter()
+	s, err := server.New(server.Config{Types: types, ScheduleInterval: 10 * time.Millisecond}, store)
+	require.NoError(t, err)
+	require.NoError(t, s.Start(r))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.RunScheduler(ctx)
+	testServer := httptest.NewServer(r)
+	return testServer.URL + "/api", func() {
+		cancel()
+		testServer.Close()
+	}
+}
+
+func TestServer_SchedulePublishesAndUnpublishes(t *testing.T) {
+	store, err := datastore.NewMemory(datastore.Record{Type: PagesType, Id: "1", Data: server.Object{"id": "1", "title": "Home"}})
+	require.NoError(t, err)
+	url, closeFn := startScheduler(t, store, PagesType)
+	defer closeFn()
+
+	resp := authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/1", url), `{"id": "1", "title": "Welcome"}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	publishAt := time.Now().Add(200 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	unpublishAt := time.Now().Add(400 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	schedule := fmt.Sprintf(`{"publishAt": %q, "unpublishAt": %q}`, publishAt, unpublishAt)
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/1/_schedule", url), schedule, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, fmt.Sprintf(`{"type": "pages", "id": "1", "publishAt": %q, "unpublishAt": %q}`, publishAt, unpublishAt), readBody(t, resp))
+	assert.JSONEq(t, fmt.Sprintf(`[{"type": "pages", "id": "1", "publishAt": %q, "unpublishAt": %q}]`, publishAt, unpublishAt),
+		getBody(t, fmt.Sprintf("%s/_schedules", url), http.StatusOK))
+
+	assert.Eventually(t, func() bool {
+		published, err := store.Get(PagesType, "1")
+		return err == nil && published["title"] == "Welcome"
+	}, time.Second, 10*time.Millisecond)
+	assert.JSONEq(t, fmt.Sprintf(`{"type": "pages", "id": "1", "unpublishAt": %q}`, unpublishAt),
+		getBody(t, fmt.Sprintf("%s/pages/1/_schedule", url), http.StatusOK))
+
+	assert.Eventually(t, func() bool {
+		_, err := store.Get(PagesType, "1")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.JSONEq(t, `{"id": "1", "title": "Welcome"}`, getBody(t, fmt.Sprintf("%s/pages/1?stage=draft", url), http.StatusOK))
+	assert.JSONEq(t, `[]`, getBody(t, fmt.Sprintf("%s/_schedules", url), http.StatusOK))
+	getBody(t, fmt.Sprintf("%s/pages/1/_schedule", url), http.StatusNotFound)
+}
+
+func TestServer_ScheduleValidation(t *testing.T) {
+	store, err := datastore.NewMemory(datastore.Record{Type: PagesType, Id: "1", Data: server.Object{"id": "1", "title": "Home"}})
+	require.NoError(t, err)
+	url, closeFn := startServer(store, PagesType)
+	defer closeFn()
+
+	resp := authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/1/_schedule", url), `{}`, "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/1/_schedule", url), `{"publishAt": "2030-01-02T00:00:00Z", "unpublishAt": "2030-01-01T00:00:00Z"}`, "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/2/_schedule", url), `{"publishAt": "2030-01-01T00:00:00Z"}`, "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/1/_schedule", url), `{"publishAt": "2030-01-01T00:00:00Z"}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/pages/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.JSONEq(t, `[]`, getBody(t, fmt.Sprintf("%s/_schedules", url), http.StatusOK))
+}
+
+func TestServer_ScheduleKeepsFailedPublishes(t *testing.T) {
+	pages := PagesType
+	pages.Unique = []string{"title"}
+	store, err := datastore.NewMemory(
+		datastore.Record{Type: pages, Id: "1", Data: server.Object{"id": "1", "title": "Home"}},
+		datastore.Record{Type: pages, Id: "2", Data: server.Object{"id": "2", "title": "Welcome"}},
+	)
+	require.NoError(t, err)
+	url, closeFn := startScheduler(t, store, pages)
+	defer closeFn()
+
+	resp := authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/1", url), `{"id": "1", "title": "Welcome"}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	publishAt := time.Now().UTC().Format(time.RFC3339Nano)
+	unpublishAt := time.Now().Add(50 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	schedule := fmt.Sprintf(`{"publishAt": %q, "unpublishAt": %q}`, publishAt, unpublishAt)
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/1/_schedule", url), schedule, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var sc server.Schedule
+	assert.Eventually(t, func() bool {
+		return json.Unmarshal([]byte(getBody(t, fmt.Sprintf("%s/pages/1/_schedule", url), http.StatusOK)), &sc) == nil && sc.LastError != ""
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(t, sc.LastError, "unable to publish")
+	assert.NotNil(t, sc.PublishAt, "the publish is retried")
+	time.Sleep(100 * time.Millisecond)
+	published, err := store.Get(pages, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "Home", published["title"], "the unpublish waits for the publish")
+
+	require.NoError(t, store.Delete(pages, "2"))
+	assert.Eventually(t, func() bool {
+		_, err := store.Get(pages, "1")
+		return errors.Is(err, server.ErrNotFound)
+	}, time.Second, 10*time.Millisecond)
+	assert.JSONEq(t, `{"id": "1", "title": "Welcome"}`, getBody(t, fmt.Sprintf("%s/pages/1?stage=draft", url), http.StatusOK))
+	assert.JSONEq(t, `[]`, getBody(t, fmt.Sprintf("%s/_schedules", url), http.StatusOK))
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BundleSchemas loads schemas referenced by Type.SchemaFile and inlines every $ref, so each
+// returned type carries a single self-contained schema that can be validated and served as is.
+//
+// A $ref may point inside the same schema ("#/$defs/address"), to another file relative to the
+// referencing file ("common.json#/$defs/address"), or to the schema of another type either by its
+// name ("users") or its $id. Relative schema files are resolved against baseDir.
+func BundleSchemas(types []Type, baseDir string) ([]Type, error) {
+	b := bundler{docs: map[string]*schemaDoc{}, byName: map[string]string{}, byId: map[string]string{}}
+
+	keys := make([]string, 0)
+	ids := map[string]int{}
+	for _, t := range types {
+		var (
+			doc *schemaDoc
+			err error
+		)
+		if t.SchemaFile != "" {
+			doc, err = b.loadFile(resolvePath(baseDir, t.SchemaFile))
+		} else {
+			doc, err = b.add("type:"+t.Name, baseDir, []byte(t.Schema))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to load schema for type %s: %w", t.Name, err)
+		}
+		keys = append(keys, doc.key)
+		b.byName[t.Name] = doc.key
+
+		if root, ok := doc.root.(*orderedObject); ok {
+			if id, hasId := root.get("$id"); hasId {
+				if idStr, isStr := id.(string); isStr {
+					ids[idStr]++
+					b.byId[idStr] = doc.key
+				}
+			}
+		}
+	}
+	// an $id shared by several types can't be used to tell them apart
+	for id, count := range ids {
+		if count > 1 {
+			delete(b.byId, id)
+		}
+	}
+
+	bundled := make([]Type, 0)
+	for i, t := range types {
+		doc := b.docs[keys[i]]
+		if t.SchemaFile == "" && !containsRef(doc.root) {
+			bundled = append(bundled, t)
+			continue
+		}
+
+		resolved, err := b.resolve(doc, doc.root, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve schema for type %s: %w", t.Name, err)
+		}
+		if root, ok := resolved.(*orderedObject); ok {
+			root.remove("$defs", "definitions")
+		}
+
+		out, err := json.MarshalIndent(resolved, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("unable to write schema for type %s: %w", t.Name, err)
+		}
+		t.Schema = string(out)
+		bundled = append(bundled, t)
+	}
+	return bundled, nil
+}
+
+type schemaDoc struct {
+	key  string
+	dir  string
+	root interface{}
+}
+
+type bundler struct {
+	docs   map[string]*schemaDoc
+	byName map[string]string
+	byId   map[string]string
+}
+
+func (b *bundler) add(key, dir string, data []byte) (*schemaDoc, error) {
+	root, err := decodeOrdered(data)
+	if err != nil {
+		return nil, err
+	}
+	doc := &schemaDoc{key: key, dir: dir, root: root}
+	b.docs[key] = doc
+	return doc, nil
+}
+
+func (b *bundler) loadFile(path string) (*schemaDoc, error) {
+	if doc, ok := b.docs[path]; ok {
+		return doc, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := b.add(path, filepath.Dir(path), data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	return doc, nil
+}
+
+// target finds the document a $ref points to, relative to the document containing it.
+func (b *bundler) target(from *schemaDoc, ref string) (*schemaDoc, string, error) {
+	location, fragment, _ := strings.Cut(ref, "#")
+
+	var (
+		doc *schemaDoc
+		err error
+	)
+	switch {
+	case location == "":
+		doc = from
+	case b.byName[location] != "":
+		doc = b.docs[b.byName[location]]
+	case b.byId[location] != "":
+		doc = b.docs[b.byId[location]]
+	case strings.Contains(location, "://"):
+		return nil, "", fmt.Errorf("unable to resolve $ref %s: remote references are not supported", ref)
+	default:
+		doc, err = b.loadFile(resolvePath(from.dir, location))
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to resolve $ref %s: %w", ref, err)
+		}
+	}
+
+	fragment, err = url.PathUnescape(fragment)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid $ref %s: %w", ref, err)
+	}
+	return doc, fragment, nil
+}
+
+// resolve returns a copy of node with every $ref replaced by the schema it points to.
+// Sibling keywords of a $ref are kept by combining them with the referenced schema in an allOf.
+func (b *bundler) resolve(doc *schemaDoc, node interface{}, stack []string) (interface{}, error) {
+	switch n := node.(type) {
+	case *orderedObject:
+		if ref, ok := n.get("$ref"); ok {
+			if refStr, isStr := ref.(string); isStr {
+				return b.resolveRef(doc, n, refStr, stack)
+			}
+		}
+		out := &orderedObject{}
+		for _, m := range n.members {
+			value, err := b.resolve(doc, m.value, stack)
+			if err != nil {
+				return nil, err
+			}
+			out.set(m.key, value)
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, 0, len(n))
+		for _, item := range n {
+			value, err := b.resolve(doc, item, stack)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, value)
+		}
+		return out, nil
+	default:
+		return n, nil
+	}
+}
+
+func (b *bundler) resolveRef(doc *schemaDoc, node *orderedObject, ref string, stack []string) (interface{}, error) {
+	targetDoc, fragment, err := b.target(doc, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	key := targetDoc.key + "#" + fragment
+	for _, seen := range stack {
+		if seen == key {
+			return nil, fmt.Errorf("unable to resolve $ref %s: recursive references are not supported", ref)
+		}
+	}
+
+	targetNode, err := lookupPointer(targetDoc.root, fragment)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve $ref %s: %w", ref, err)
+	}
+	resolved, err := b.resolve(targetDoc, targetNode, append(stack, key))
+	if err != nil {
+		return nil, err
+	}
+	if obj, ok := resolved.(*orderedObject); ok && fragment == "" {
+		obj.remove("$id", "$schema", "$defs", "definitions")
+	}
+
+	if len(node.members) == 1 {
+		return resolved, nil
+	}
+	out := &orderedObject{}
+	allOf := make([]interface{}, 0)
+	for _, m := range node.members {
+		if m.key == "$ref" {
+			continue
+		}
+		value, err := b.resolve(doc, m.value, stack)
+		if err != nil {
+			return nil, err
+		}
+		if existing, isArray := value.([]interface{}); isArray && m.key == "allOf" {
+			allOf = append(allOf, existing...)
+			continue
+		}
+		out.set(m.key, value)
+	}
+	out.set("allOf", append(allOf, resolved))
+	return out, nil
+}
+
+func lookupPointer(root interface{}, pointer string) (interface{}, error) {
+	if pointer == "" || pointer == "/" {
+		return root, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("anchor %s is not supported", pointer)
+	}
+
+	node := root
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch n := node.(type) {
+		case *orderedObject:
+			value, ok := n.get(token)
+			if !ok {
+				return nil, fmt.Errorf("no %s found", pointer)
+			}
+			node = value
+		case []interface{}:
+			var index int
+			_, err := fmt.Sscanf(token, "%d", &index)
+			if err != nil || index < 0 || index >= len(n) {
+				return nil, fmt.Errorf("no %s found", pointer)
+			}
+			node = n[index]
+		default:
+			return nil, fmt.Errorf("no %s found", pointer)
+		}
+	}
+	return node, nil
+}
+
+func containsRef(node interface{}) bool {
+	switch n := node.(type) {
+	case *orderedObject:
+		for _, m := range n.members {
+			if m.key == "$ref" || containsRef(m.value) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range n {
+			if containsRef(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func resolvePath(baseDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+// orderedObject is a JSON object that keeps the order of its keys, so bundled schemas
+// list properties in the order they were written.
+type orderedObject struct {
+	members []member
+}
+
+type member struct {
+	key   string
+	value interface{}
+}
+
+func (o *orderedObject) get(key string) (interface{}, bool) {
+	for _, m := range o.members {
+		if m.key == key {
+			return m.value, true
+		}
+	}
+	return nil, false
+}
+
+func (o *orderedObject) set(key string, value interface{}) {
+	for i, m := range o.members {
+		if m.key == key {
+			o.members[i].value = value
+			return
+		}
+	}
+	o.members = append(o.members, member{key: key, value: value})
+}
+
+func (o *orderedObject) remove(keys ...string) {
+	kept := make([]member, 0, len(o.members))
+	for _, m := range o.members {
+		removed := false
+		for _, key := range keys {
+			removed = removed || m.key == key
+		}
+		if !removed {
+			kept = append(kept, m)
+		}
+	}
+	o.members = kept
+}
+
+func (o *orderedObject) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, m := range o.members {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(m.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func decodeOrdered(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decodeValue(decoder)
+}
+
+func decodeValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		obj := &orderedObject{}
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(keyToken.(string), value)
+		}
+		_, err = decoder.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := make([]interface{}, 0)
+		for decoder.More() {
+			value, err := decodeValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err = decoder.Token()
+		return arr, err
+	default:
+		return token, nil
+	}
+}
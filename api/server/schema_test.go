@@ -0,0 +1,115 @@
+package server_test
+
+import (
+	"crswty.com/cms/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBundleSchemas_ResolvesFilesAndTypes(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "schemas"), 0755))
+	writeFile(t, filepath.Join(dir, "schemas", "common.json"),
+		// language=json
+		`{
+	"$defs": {
+		"phone": { "type": "object", "properties": { "home": { "type": "number" } } }
+	}
+}`)
+	writeFile(t, filepath.Join(dir, "schemas", "users.json"),
+		// language=json
+		`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "$ref": "#/$defs/id" },
+		"phone": { "$ref": "common.json#/$defs/phone", "description": "contact number" }
+	},
+	"$defs": {
+		"id": { "type": "string" }
+	}
+}`)
+
+	types := []server.Type{
+		{Name: "users", Id: "id", SchemaFile: "schemas/users.json"},
+		{Name: "pets", Id: "id", Schema:
+		// language=json
+		`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"owner": { "$ref": "users#/properties/id" }
+	}
+}`},
+		{Name: "plain", Id: "id", Schema: `{"type": "object"}`},
+	}
+
+	bundled, err := server.BundleSchemas(types, dir)
+	require.NoError(t, err)
+	require.Len(t, bundled, 3)
+
+	assert.JSONEq(t,
+		// language=json
+		`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"phone": {
+			"description": "contact number",
+			"allOf": [{ "type": "object", "properties": { "home": { "type": "number" } } }]
+		}
+	}
+}`, bundled[0].Schema)
+
+	assert.JSONEq(t,
+		// language=json
+		`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"owner": { "type": "string" }
+	}
+}`, bundled[1].Schema)
+
+	assert.Equal(t, `{"type": "object"}`, bundled[2].Schema)
+}
+
+func TestBundleSchemas_KeepsPropertyOrder(t *testing.T) {
+	bundled, err := server.BundleSchemas([]server.Type{{Name: "a", Schema:
+	// language=json
+	`{"$defs": {"s": {"type": "string"}}, "properties": {"z": {"$ref": "#/$defs/s"}, "a": {"$ref": "#/$defs/s"}}}`}}, "")
+	require.NoError(t, err)
+
+	assert.Equal(t, `{
+  "properties": {
+    "z": {
+      "type": "string"
+    },
+    "a": {
+      "type": "string"
+    }
+  }
+}`, bundled[0].Schema)
+}
+
+func TestBundleSchemas_RejectsRecursiveRefs(t *testing.T) {
+	_, err := server.BundleSchemas([]server.Type{{Name: "tree", Schema:
+	// language=json
+	`{"properties": {"children": {"type": "array", "items": {"$ref": "#"}}}}`}}, "")
+	assert.ErrorContains(t, err, "recursive references are not supported")
+}
+
+func TestBundleSchemas_RejectsMissingFile(t *testing.T) {
+	_, err := server.BundleSchemas([]server.Type{{Name: "users", SchemaFile: "missing.json"}}, t.TempDir())
+	assert.Error(t, err)
+}
+
+func writeFile(t *testing.T, path, content string) {
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
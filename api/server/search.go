@@ -0,0 +1,269 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 ranking parameters, the commonly used defaults.
+const (
+	searchK1 = 1.2
+	searchB  = 0.75
+)
+
+// searchIndex is an in-process inverted index over the Type.Search fields of each type. It is built from
+// the provider on start and updated by every write made through the server.
+type searchIndex struct {
+	lock  sync.RWMutex
+	types map[string]*typeIndex
+}
+
+type typeIndex struct {
+	// fields are indexed apart, so queries can leave out the fields a principal can't read
+	fields map[string]*fieldIndex
+	docs   map[string]bool
+}
+
+type fieldIndex struct {
+	// postings maps each term to the number of times it occurs in each document
+	postings map[string]map[string]int
+	// terms holds the distinct terms of each document, so it can be removed from the postings
+	terms       map[string][]string
+	lengths     map[string]int
+	totalLength int
+}
+
+type searchResult struct {
+	Id    string
+	Score float64
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{types: map[string]*typeIndex{}}
+}
+
+func newTypeIndex() *typeIndex {
+	return &typeIndex{fields: map[string]*fieldIndex{}, docs: map[string]bool{}}
+}
+
+func newFieldIndex() *fieldIndex {
+	return &fieldIndex{postings: map[string]map[string]int{}, terms: map[string][]string{}, lengths: map[string]int{}}
+}
+
+// rebuild replaces the index of t with one built from every object the provider holds.
+func (i *searchIndex) rebuild(t Type, store DataProvider) error {
+	if len(t.Search) == 0 {
+		return nil
+	}
+	objs, err := store.List(t)
+	if err != nil {
+		return fmt.Errorf("unable to build search index for %s: %w", t.Name, err)
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.types[t.Name] = newTypeIndex()
+	for _, obj := range objs {
+		id, ok := IndexValue(obj[t.Id])
+		if !ok {
+			continue
+		}
+		i.index(t, id, obj)
+	}
+	return nil
+}
+
+func (i *searchIndex) put(t Type, id string, obj Object) {
+	if len(t.Search) == 0 {
+		return
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.unindex(t, id)
+	i.index(t, id, obj)
+}
+
+func (i *searchIndex) remove(t Type, id string) {
+	if len(t.Search) == 0 {
+		return
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.unindex(t, id)
+}
+
+func (i *searchIndex) index(t Type, id string, obj Object) {
+	idx := i.types[t.Name]
+	if idx == nil {
+		idx = newTypeIndex()
+		i.types[t.Name] = idx
+	}
+
+	idx.docs[id] = true
+	for _, field := range t.Search {
+		f := idx.fields[field]
+		if f == nil {
+			f = newFieldIndex()
+			idx.fields[field] = f
+		}
+		terms := tokenize(searchableText(obj[field]))
+		for _, term := range terms {
+			if f.postings[term] == nil {
+				f.postings[term] = map[string]int{}
+			}
+			f.postings[term][id]++
+		}
+		f.terms[id] = uniqueTerms(terms)
+		f.lengths[id] = len(terms)
+		f.totalLength += len(terms)
+	}
+}
+
+func (i *searchIndex) unindex(t Type, id string) {
+	idx := i.types[t.Name]
+	if idx == nil || !idx.docs[id] {
+		return
+	}
+	delete(idx.docs, id)
+	for _, f := range idx.fields {
+		for _, term := range f.terms[id] {
+			delete(f.postings[term], id)
+			if len(f.postings[term]) == 0 {
+				delete(f.postings, term)
+			}
+		}
+		f.totalLength -= f.lengths[id]
+		delete(f.terms, id)
+		delete(f.lengths, id)
+	}
+}
+
+// query ranks the documents of t containing any of the query terms in fields other than excluded with BM25, best
+// match first.
+func (i *searchIndex) query(t Type, q string, excluded []string) []searchResult {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	idx := i.types[t.Name]
+	if idx == nil || len(idx.docs) == 0 {
+		return []searchResult{}
+	}
+	fields := make([]*fieldIndex, 0, len(idx.fields))
+	totalLength := 0
+	for name, f := range idx.fields {
+		if !contains(excluded, name) {
+			fields = append(fields, f)
+			totalLength += f.totalLength
+		}
+	}
+	if totalLength == 0 {
+		return []searchResult{}
+	}
+
+	docCount := float64(len(idx.docs))
+	avgLength := float64(totalLength) / docCount
+	scores := map[string]float64{}
+	for _, term := range uniqueTerms(tokenize(q)) {
+		docs := map[string]int{}
+		for _, f := range fields {
+			for id, frequency := range f.postings[term] {
+				docs[id] += frequency
+			}
+		}
+		idf := math.Log(1 + (docCount-float64(len(docs))+0.5)/(float64(len(docs))+0.5))
+		for id, frequency := range docs {
+			length := 0
+			for _, f := range fields {
+				length += f.lengths[id]
+			}
+			tf := float64(frequency)
+			norm := 1 - searchB + searchB*float64(length)/avgLength
+			scores[id] += idf * tf * (searchK1 + 1) / (tf + searchK1*norm)
+		}
+	}
+
+	results := make([]searchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, searchResult{Id: id, Score: score})
+	}
+	sort.Slice(results, func(a, b int) bool {
+		if results[a].Score != results[b].Score {
+			return results[a].Score > results[b].Score
+		}
+		return results[a].Id < results[b].Id
+	})
+	return results
+}
+
+// searchObjects returns the objects of t matching q in fields other than excluded, most relevant first.
+func (s Server) searchObjects(t Type, q string, excluded []string) ([]Object, error) {
+	results := s.search.query(t, q, excluded)
+	ids := make([]string, 0, len(results))
+	for _, result := range results {
+		ids = append(ids, result.Id)
+	}
+
+	found, err := s.getMany(t, ids)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]Object, 0, len(ids))
+	for _, id := range ids {
+		if obj, ok := found[id]; ok {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+func searchableText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, searchableText(item))
+		}
+		return strings.Join(parts, " ")
+	default:
+		if indexed, ok := IndexValue(v); ok {
+			return indexed
+		}
+		return ""
+	}
+}
+
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for i, word := range words {
+		words[i] = stem(word)
+	}
+	return words
+}
+
+// stem reduces simple English plurals to their singular, so "cows" matches "cow".
+func stem(word string) string {
+	if len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") {
+		return strings.TrimSuffix(word, "s")
+	}
+	return word
+}
+
+func uniqueTerms(terms []string) []string {
+	unique := make([]string, 0, len(terms))
+	seen := map[string]bool{}
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			unique = append(unique, term)
+		}
+	}
+	return unique
+}
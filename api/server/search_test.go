@@ -0,0 +1,67 @@
+package server_test
+
+import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var ArticlesType = server.Type{Name: "articles", Id: "id", Search: []string{"title", "body"}, Schema:
+// language=json
+`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"title": { "type": "string" },
+		"body": { "type": "string" }
+	}
+}`}
+
+func TestServer_SearchRanksByRelevance(t *testing.T) {
+	store, err := datastore.NewMemory(
+		datastore.Record{Type: ArticlesType, Id: "1", Data: server.Object{"id": "1", "title": "Keeping cows", "body": "Cows need a field."}},
+		datastore.Record{Type: ArticlesType, Id: "2", Data: server.Object{"id": "2", "title": "Dinosaurs", "body": "A trex is not a cow."}},
+		datastore.Record{Type: ArticlesType, Id: "3", Data: server.Object{"id": "3", "title": "Ducks", "body": "Ducks swim."}},
+	)
+	require.NoError(t, err)
+
+	url, closeFn := startServer(store, ArticlesType)
+	defer closeFn()
+
+	body := getBody(t, fmt.Sprintf("%s/articles/_search?q=cows", url), http.StatusOK)
+	assert.JSONEq(t, `[{"id": "1", "title": "Keeping cows", "body": "Cows need a field."}, {"id": "2", "title": "Dinosaurs", "body": "A trex is not a cow."}]`, body)
+
+	body = getBody(t, fmt.Sprintf("%s/articles/_search?q=Duck+dinosaur", url), http.StatusOK)
+	assert.JSONEq(t, `[{"id": "3", "title": "Ducks", "body": "Ducks swim."}, {"id": "2", "title": "Dinosaurs", "body": "A trex is not a cow."}]`, body)
+}
+
+func TestServer_SearchIsUpdatedOnWrite(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+
+	url, closeFn := startServer(store, ArticlesType)
+	defer closeFn()
+
+	resp, err := http.Post(fmt.Sprintf("%s/articles", url), "application/json", strings.NewReader(`{"id": "1", "title": "Llamas", "body": "spitting"}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.JSONEq(t, `[{"id": "1", "title": "Llamas", "body": "spitting"}]`, getBody(t, fmt.Sprintf("%s/articles/_search?q=llamas", url), http.StatusOK))
+
+	request, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/articles/1", url), strings.NewReader(`{"id": "1", "title": "Alpacas", "body": "fluffy"}`))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[]`, getBody(t, fmt.Sprintf("%s/articles/_search?q=llamas", url), http.StatusOK))
+	assert.JSONEq(t, `[{"id": "1", "title": "Alpacas", "body": "fluffy"}]`, getBody(t, fmt.Sprintf("%s/articles/_search?q=fluffy", url), http.StatusOK))
+
+	resp = deleteRequest(t, fmt.Sprintf("%s/articles/1", url))
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.JSONEq(t, `[]`, getBody(t, fmt.Sprintf("%s/articles/_search?q=fluffy", url), http.StatusOK))
+}
@@ -2,35 +2,109 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/xeipuuv/gojsonschema"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Server struct {
 	Config    Config
 	DataStore DataProvider
+
+	relations  map[string][]Relation
+	validators map[string]Validator
+	search     *searchIndex
+	tokens     *tokenVerifier
+	sessions   *sessions
+	events     *eventBus
+	instance   string
 }
 type Type struct {
-	Name   string
-	Id     string
-	Schema string
+	Name       string
+	Id         string
+	Schema     string
+	SchemaFile string
+	// Unique fields can't hold the same value in two objects of the type, providers reject such writes with ErrConflict.
+	Unique []string
+	// Indexes are fields providers keep a secondary index of, so filtering on them doesn't read every object.
+	Indexes []string
+	// Search fields are indexed for full text search.
+	Search []string
+	// Owner is the field stamped with the principal creating an object, principals without ScopeAdmin on the
+	// type can only see and change the objects they own.
+	Owner string
+	// Public types are served read only by the delivery API.
+	Public bool
+	// PublicFields limits the fields the delivery API serves, all of them are when it's empty.
+	PublicFields []string
+	// Workflow is WorkflowDraft for types whose changes are staged as drafts until they are published.
+	Workflow string
+	// SoftDelete types move deleted objects to a trash, where they can be restored until they are purged.
+	SoftDelete bool
+	// TrashRetention is how long deleted objects are kept in the trash, DefaultTrashRetention when it isn't set.
+	TrashRetention time.Duration
+
+	// relationFields are the fields of the relations, set on the types of a server once it has parsed them.
+	relationFields []string
+}
+
+// Internal reports whether t is one the server keeps its own records in, such as the outbox or the trash of a type,
+// rather than content. Their names have a segment starting with an underscore, drafts are content.
+func (t Type) Internal() bool {
+	name := strings.TrimSuffix(t.Name, "/_draft")
+	return strings.HasPrefix(name, "_") || strings.Contains(name, "/_")
 }
+
 type Config struct {
-	Types       []Type
-	Schema      string
-	AdminAssets string
+	Types          []Type
+	Schema         string
+	AdminAssets    string
+	MaxExpandDepth int
+	Auth           AuthConfig
+	// ContentPath is where the delivery API serving public types is routed.
+	ContentPath   string
+	ContentMaxAge time.Duration
+	// ScheduleInterval is how often RunScheduler applies due schedules.
+	ScheduleInterval time.Duration
+	// SweepInterval is how often RunSweeper purges expired objects from the trash.
+	SweepInterval time.Duration
+	// Audit records every change made through the api when it is set.
+	Audit AuditSink
+	// EventBuffer is how many recent events are kept for clients resuming an event stream.
+	EventBuffer int
+	// Webhooks are called with the changes to content by RunWebhooks.
+	Webhooks        []Webhook
+	WebhookInterval time.Duration
+	WebhookBackoff  time.Duration
+	WebhookAttempts int
+	// Publishers are sent every change by RunPublishers.
+	Publishers []Publisher
+	// Outbox records events in the provider before the writes they describe, RunOutbox relays them every
+	// OutboxInterval.
+	Outbox         bool
+	OutboxInterval time.Duration
 }
 
 type Object map[string]interface{}
 
+var (
+	// ErrNotFound is returned by providers, wrapped, when the requested object does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned, wrapped, when a write conflicts with the data already stored.
+	ErrConflict = errors.New("conflict")
+	// ErrBadRequest is returned, wrapped, when request parameters can't be used.
+	ErrBadRequest = errors.New("bad request")
+)
+
 type DataProvider interface {
 	List(t Type) ([]Object, error)
 	Get(t Type, id string) (Object, error)
@@ -39,9 +113,86 @@ type DataProvider interface {
 	Delete(t Type, id string) error
 }
 
-func (s Server) Start(r chi.Router) {
+// New prepares a server for the config: it loads the relations between the types, indexes their objects for search
+// and sets up authentication. The RunX methods must be called on a server made by New, so they share the events and
+// the search index of the api served by Start.
+func New(config Config, dataStore DataProvider) (*Server, error) {
+	s := &Server{Config: config, DataStore: dataStore}
+	err := s.setUp()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// setUp creates the state the copies of the server share, its handlers are closures over a copy.
+func (s *Server) setUp() error {
+	s.instance = newInstanceId()
+
+	s.validators = map[string]Validator{}
+	for _, t := range s.Config.Types {
+		validator, err := NewValidator(t.Schema)
+		if err != nil {
+			return fmt.Errorf("invalid schema for type %s: %w", t.Name, err)
+		}
+		s.validators[t.Name] = validator
+	}
+
+	relations, err := loadRelations(s.Config.Types)
+	if err != nil {
+		return err
+	}
+	s.relations = relations
+	// the types keep the fields of their relations, so providers indexing them don't parse the schema each time
+	types := make([]Type, len(s.Config.Types))
+	for i, t := range s.Config.Types {
+		t.relationFields = make([]string, 0, len(relations[t.Name]))
+		for _, r := range relations[t.Name] {
+			t.relationFields = append(t.relationFields, r.Field)
+		}
+		types[i] = t
+	}
+	s.Config.Types = types
 	config := s.Config
 
+	s.events = newEventBus(config.EventBuffer)
+
+	s.search = newSearchIndex()
+	for _, t := range config.Types {
+		err = s.search.rebuild(t, s.DataStore)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.Auth.JWT != nil {
+		s.tokens, err = newTokenVerifier(*config.Auth.JWT)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(config.Auth.Users) > 0 {
+		s.sessions, err = newSessions(config.Auth, s.DataStore)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start routes the api on r, preparing the server first when it wasn't made by New.
+func (s Server) Start(r chi.Router) error {
+	if s.events == nil {
+		err := s.setUp()
+		if err != nil {
+			return err
+		}
+	}
+	config := s.Config
+
+	root := r
+	r.Use(middleware.RequestID)
 	r.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: log.Default()}))
 
 	r.Get("/", func(writer http.ResponseWriter, request *http.Request) {
@@ -49,8 +200,19 @@ func (s Server) Start(r chi.Router) {
 	})
 
 	r.Route("/api", func(r chi.Router) {
+		r.Use(s.authenticate)
 		for _, t := range config.Types {
-			s.addEndpoints(r, t)
+			s.addEndpoints(r, t, s.validators[t.Name])
+		}
+
+		r.Get("/_schedules", s.listSchedules)
+		r.Get("/_events", s.streamEvents())
+		r.Get("/_ws", s.serveWebSocket(root))
+		if len(config.Webhooks) > 0 {
+			r.Get("/_webhooks/deliveries", s.listDeliveries)
+		}
+		if config.Audit != nil {
+			r.Get("/_audit", s.listAudit)
 		}
 
 		r.Get("/describe", func(writer http.ResponseWriter, request *http.Request) {
@@ -58,10 +220,31 @@ func (s Server) Start(r chi.Router) {
 
 			resp := make([]typeResp, 0)
 			for _, t := range config.Types {
+				if s.can(request.Context(), t.Name, ScopeRead) != nil {
+					continue
+				}
+				relations := make([]relationResp, 0)
+				for _, relation := range s.relations[t.Name] {
+					relations = append(relations, relationResp{
+						Field:    relation.Field,
+						Type:     relation.Type,
+						OnDelete: string(relation.OnDelete),
+					})
+				}
+				referencedBy := make([]relationResp, 0)
+				for _, in := range s.inbound(t.Name) {
+					referencedBy = append(referencedBy, relationResp{
+						Field:    in.Relation.Field,
+						Type:     in.Source.Name,
+						OnDelete: string(in.Relation.OnDelete),
+					})
+				}
 				resp = append(resp, typeResp{
-					Name:   t.Name,
-					Id:     t.Id,
-					Schema: t.Schema,
+					Name:         t.Name,
+					Id:           t.Id,
+					Schema:       t.Schema,
+					Relations:    relations,
+					ReferencedBy: referencedBy,
 				})
 			}
 
@@ -79,32 +262,94 @@ func (s Server) Start(r chi.Router) {
 		})
 	})
 
+	contentPath := config.ContentPath
+	if contentPath == "" {
+		contentPath = DefaultContentPath
+	}
+	r.Route(contentPath, s.addContentEndpoints)
+
 	contentDir := config.AdminAssets
 	fs := http.FileServer(http.Dir(contentDir))
-	r.Get("/admin", func(writer http.ResponseWriter, request *http.Request) {
-		http.StripPrefix("/admin", fs).ServeHTTP(writer, request)
-	})
-	r.Get("/admin/*", func(writer http.ResponseWriter, request *http.Request) {
-		if _, err := os.Stat(contentDir + strings.TrimPrefix(request.RequestURI, "/admin")); os.IsNotExist(err) {
-			http.StripPrefix(request.RequestURI, fs).ServeHTTP(writer, request)
-		} else {
+	if s.sessions != nil {
+		s.addSessionEndpoints(r)
+	}
+	r.Group(func(r chi.Router) {
+		r.Use(s.redirectToLogin, s.authenticate)
+		r.Get("/admin", func(writer http.ResponseWriter, request *http.Request) {
 			http.StripPrefix("/admin", fs).ServeHTTP(writer, request)
-		}
+		})
+		r.Get("/admin/*", func(writer http.ResponseWriter, request *http.Request) {
+			if _, err := os.Stat(contentDir + strings.TrimPrefix(request.RequestURI, "/admin")); os.IsNotExist(err) {
+				http.StripPrefix(request.RequestURI, fs).ServeHTTP(writer, request)
+			} else {
+				http.StripPrefix("/admin", fs).ServeHTTP(writer, request)
+			}
+		})
 	})
 
+	return nil
 }
 
-func (s Server) addEndpoints(r chi.Router, t Type) {
-	r.Get(fmt.Sprintf("/%s", t.Name), func(writer http.ResponseWriter, request *http.Request) {
-		data, err := s.DataStore.List(t)
+func (s Server) addEndpoints(r chi.Router, t Type, validator Validator) {
+	r.With(s.authorize(ScopeRead, t.Name)).Get(fmt.Sprintf("/%s", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+		tree, err := s.parseExpansion(t, request.URL.Query())
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		err = s.authorizeExpansion(request.Context(), t, tree)
 		if err != nil {
 			handleError(writer, err)
 			return
 		}
-		writer.Header().Set("Content-Type", "application/json")
-		writer.Header().Set("X-Total-Count", fmt.Sprintf("%d", len(data)))
 
-		b, err := json.Marshal(data)
+		f := parseFilters(request.URL.Query())
+		err = s.authorizeFields(request.Context(), t, f.fields())
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+
+		stage, err := parseStage(request.URL.Query())
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+
+		data, err := s.listStage(t, s.restrict(request.Context(), t, f), stage)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		data, err = s.expand(t, data, tree)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		s.hide(request.Context(), t, data, tree)
+		writeList(writer, data)
+	})
+
+	r.With(s.authorize(ScopeRead, t.Name)).Get(fmt.Sprintf("/%s/_aggregate", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+		q, err := s.parseAggregateQuery(t, request.URL.Query())
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		err = s.authorizeFields(request.Context(), t, q.fields())
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+
+		q.Filters = s.restrict(request.Context(), t, q.Filters)
+		rows, err := s.aggregate(t, q)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		b, err := json.Marshal(rows)
 		if err != nil {
 			handleError(writer, err)
 			return
@@ -116,16 +361,70 @@ func (s Server) addEndpoints(r chi.Router, t Type) {
 		}
 	})
 
-	r.Get(fmt.Sprintf("/%s/{id}", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+	if len(t.Search) > 0 {
+		r.With(s.authorize(ScopeRead, t.Name)).Get(fmt.Sprintf("/%s/_search", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+			tree, err := s.parseExpansion(t, request.URL.Query())
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			err = s.authorizeExpansion(request.Context(), t, tree)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+
+			// fields hidden from the principal aren't searched, matches would reveal what they hold
+			data, err := s.searchObjects(t, request.URL.Query().Get("q"), s.hiddenFields(request.Context(), t))
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			data = s.ownedOnly(request.Context(), t, data)
+			data, err = s.expand(t, data, tree)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			s.hide(request.Context(), t, data, tree)
+			writeList(writer, data)
+		})
+	}
+
+	r.With(s.authorize(ScopeRead, t.Name)).Get(fmt.Sprintf("/%s/{id}", t.Name), func(writer http.ResponseWriter, request *http.Request) {
 		writer.Header().Set("Content-Type", "application/json")
 
 		id := chi.URLParam(request, "id")
-		data, err := s.DataStore.Get(t, id)
+		tree, err := s.parseExpansion(t, request.URL.Query())
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		err = s.authorizeExpansion(request.Context(), t, tree)
 		if err != nil {
 			handleError(writer, err)
 			return
 		}
 
+		stage, err := parseStage(request.URL.Query())
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+
+		data, err := s.getOwned(request.Context(), t, id, stage)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		expanded, err := s.expand(t, []Object{data}, tree)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		s.hide(request.Context(), t, expanded, tree)
+		data = expanded[0]
+
 		b, err := json.Marshal(data)
 		if err != nil {
 			handleError(writer, err)
@@ -138,7 +437,43 @@ func (s Server) addEndpoints(r chi.Router, t Type) {
 		}
 	})
 
-	r.Post(fmt.Sprintf("/%s", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+	for _, source := range s.referencingTypes(t) {
+		source := source
+		r.With(s.authorize(ScopeRead, t.Name, source.Name)).Get(fmt.Sprintf("/%s/{id}/%s", t.Name, source.Name), func(writer http.ResponseWriter, request *http.Request) {
+			id := chi.URLParam(request, "id")
+			tree, err := s.parseExpansion(source, request.URL.Query())
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			err = s.authorizeExpansion(request.Context(), source, tree)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+
+			_, err = s.getOwned(request.Context(), t, id, StagePublished)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			data, err := s.referencedBy(t, id, source)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			data = s.ownedOnly(request.Context(), source, data)
+			data, err = s.expand(source, data, tree)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			s.hide(request.Context(), source, data, tree)
+			writeList(writer, data)
+		})
+	}
+
+	r.With(s.authorize(ScopeWrite, t.Name)).Post(fmt.Sprintf("/%s", t.Name), func(writer http.ResponseWriter, request *http.Request) {
 		writer.Header().Set("Content-Type", "application/json")
 
 		reqBytes, err := io.ReadAll(request.Body)
@@ -147,7 +482,31 @@ func (s Server) addEndpoints(r chi.Router, t Type) {
 			return
 		}
 
-		valid, validationErrors, err := validate(t.Schema, string(reqBytes))
+		var obj Object
+		err = json.Unmarshal(reqBytes, &obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		_, err = s.authorizeWrite(request.Context(), t, "", obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		stamped, err := s.authorizeOwner(request.Context(), t, "", obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		if stamped {
+			reqBytes, err = json.Marshal(obj)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+		}
+
+		valid, validationErrors, err := validator.Validate(string(reqBytes))
 		if err != nil {
 			handleError(writer, err)
 			return
@@ -157,23 +516,45 @@ func (s Server) addEndpoints(r chi.Router, t Type) {
 			return
 		}
 
-		var obj Object
-		err = json.Unmarshal(reqBytes, &obj)
+		referenceErrors, err := s.checkReferences(t, obj)
 		if err != nil {
 			handleError(writer, err)
 			return
 		}
+		if len(referenceErrors) > 0 {
+			handleValidationError(writer, referenceErrors)
+			return
+		}
 
 		idStr, err := idToString(obj[t.Id])
 		if err != nil {
 			handleError(writer, err)
 			return
 		}
-		err = s.DataStore.Create(t, idStr, obj)
+		// a post replaces the object with the same id, principals restricted to their own objects can't replace one
+		// they don't own
+		before, err := s.getStage(t, idStr, StageDraft)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			handleError(writer, err)
+			return
+		}
+		if err != nil {
+			before = nil
+		}
+		if before != nil && !s.owns(request.Context(), t, before) {
+			handleError(writer, fmt.Errorf("%w: %s %s already exists", ErrConflict, t.Name, idStr))
+			return
+		}
+		err = s.create(t.writeType(), idStr, obj)
 		if err != nil {
 			handleError(writer, err)
 			return
 		}
+		operation := OpCreate
+		if before != nil {
+			operation = OpUpdate
+		}
+		s.audit(request.Context(), t, idStr, operation, before, obj)
 
 		writer.WriteHeader(http.StatusCreated)
 		_, err = writer.Write(reqBytes)
@@ -183,7 +564,7 @@ func (s Server) addEndpoints(r chi.Router, t Type) {
 		}
 	})
 
-	r.Put(fmt.Sprintf("/%s/{id}", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+	r.With(s.authorize(ScopeWrite, t.Name)).Put(fmt.Sprintf("/%s/{id}", t.Name), func(writer http.ResponseWriter, request *http.Request) {
 		writer.Header().Set("Content-Type", "application/json")
 
 		id := chi.URLParam(request, "id")
@@ -199,8 +580,25 @@ func (s Server) addEndpoints(r chi.Router, t Type) {
 			handleError(writer, err)
 			return
 		}
+		restored, err := s.authorizeWrite(request.Context(), t, id, obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		stamped, err := s.authorizeOwner(request.Context(), t, id, obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		if restored || stamped {
+			reqBytes, err = json.Marshal(obj)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+		}
 
-		valid, validationErrors, err := validate(t.Schema, string(reqBytes))
+		valid, validationErrors, err := validator.Validate(string(reqBytes))
 		if err != nil {
 			handleError(writer, err)
 			return
@@ -210,12 +608,37 @@ func (s Server) addEndpoints(r chi.Router, t Type) {
 			return
 		}
 
-		err = s.DataStore.Update(t, id, obj)
+		referenceErrors, err := s.checkReferences(t, obj)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		if len(referenceErrors) > 0 {
+			handleValidationError(writer, referenceErrors)
+			return
+		}
+
+		before := s.auditBefore(t, id, StageDraft)
+		err = s.update(t.writeType(), id, obj)
 		if err != nil {
 			handleError(writer, err)
 			return
 		}
+		if before == nil {
+			s.audit(request.Context(), t, id, OpCreate, nil, obj)
+		} else {
+			s.audit(request.Context(), t, id, OpUpdate, before, obj)
+		}
 
+		if len(s.hiddenFields(request.Context(), t)) > 0 {
+			written := copyObject(obj)
+			s.hide(request.Context(), t, []Object{written}, nil)
+			reqBytes, err = json.Marshal(written)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+		}
 		writer.WriteHeader(http.StatusOK)
 		_, err = writer.Write(reqBytes)
 		if err != nil {
@@ -224,34 +647,106 @@ func (s Server) addEndpoints(r chi.Router, t Type) {
 		}
 	})
 
-	r.Delete(fmt.Sprintf("/%s/{id}", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+	r.With(s.authorize(ScopeDelete, t.Name)).Delete(fmt.Sprintf("/%s/{id}", t.Name), func(writer http.ResponseWriter, request *http.Request) {
 		writer.Header().Set("Content-Type", "application/json")
 		id := chi.URLParam(request, "id")
 
-		err := s.DataStore.Delete(t, id)
+		if _, restricted := s.ownedBy(request.Context(), t); restricted {
+			_, err := s.getOwned(request.Context(), t, id, StageDraft)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+		}
+		before := s.auditBefore(t, id, StageDraft)
+		err := s.discard(request.Context(), t, id)
 		if err != nil {
 			handleError(writer, err)
 			return
 		}
+		s.audit(request.Context(), t, id, OpDelete, before, nil)
 
 		writer.WriteHeader(http.StatusNoContent)
 	})
+
+	if t.hasDrafts() {
+		r.With(s.authorize(ScopePublish, t.Name)).Post(fmt.Sprintf("/%s/{id}/_publish", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+			writer.Header().Set("Content-Type", "application/json")
+			id := chi.URLParam(request, "id")
+
+			draft, err := s.getOwned(request.Context(), t, id, StageDraft)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			referenceErrors, err := s.checkReferences(t, draft)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			if len(referenceErrors) > 0 {
+				handleValidationError(writer, referenceErrors)
+				return
+			}
+			before := s.auditBefore(t, id, StagePublished)
+			data, err := s.publish(t, id)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			s.audit(request.Context(), t, id, OpPublish, before, data)
+
+			published := copyObject(data)
+			s.hide(request.Context(), t, []Object{published}, nil)
+			b, err := json.Marshal(published)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+			_, err = writer.Write(b)
+			if err != nil {
+				handleError(writer, err)
+				return
+			}
+		})
+
+		s.addScheduleEndpoints(r, t)
+	}
+	s.addHistoryEndpoints(r, t, validator)
+	r.With(s.authorize(ScopeRead, t.Name)).Get(fmt.Sprintf("/%s/_events", t.Name), s.streamEvents(t.Name))
+	if t.SoftDelete {
+		s.addTrashEndpoints(r, t, validator)
+	}
 }
 
-func validate(schema, content string) (bool, []string, error) {
-	schemaLoader := gojsonschema.NewStringLoader(schema)
-	contentLoader := gojsonschema.NewStringLoader(content)
-	result, err := gojsonschema.Validate(schemaLoader, contentLoader)
+func writeList(writer http.ResponseWriter, data []Object) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("X-Total-Count", fmt.Sprintf("%d", len(data)))
+
+	b, err := json.Marshal(data)
 	if err != nil {
-		return false, nil, err
+		handleError(writer, err)
+		return
 	}
-
-	errs := make([]string, 0)
-	for _, resultError := range result.Errors() {
-		errs = append(errs, resultError.String())
+	_, err = writer.Write(b)
+	if err != nil {
+		handleError(writer, err)
+		return
 	}
+}
 
-	return result.Valid(), errs, nil
+func writeJSON(writer http.ResponseWriter, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	b, err := json.Marshal(v)
+	if err != nil {
+		handleError(writer, err)
+		return
+	}
+	_, err = writer.Write(b)
+	if err != nil {
+		handleError(writer, err)
+		return
+	}
 }
 
 type errorResp struct {
@@ -279,18 +774,43 @@ func handleError(writer http.ResponseWriter, e error) {
 		log.Printf("error handling error: %s \n", err)
 		return
 	}
-	writer.WriteHeader(http.StatusInternalServerError)
+	writer.WriteHeader(errorStatus(e))
 	_, _ = writer.Write(body)
 }
 
+func errorStatus(e error) int {
+	switch {
+	case errors.Is(e, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(e, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(e, ErrBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(e, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(e, ErrForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 type describeResp struct {
 	Types []typeResp `json:"types"`
 }
 
 type typeResp struct {
-	Name   string `json:"name"`
-	Id     string `json:"id"`
-	Schema string `json:"schema"`
+	Name         string         `json:"name"`
+	Id           string         `json:"id"`
+	Schema       string         `json:"schema"`
+	Relations    []relationResp `json:"relations"`
+	ReferencedBy []relationResp `json:"referencedBy"`
+}
+
+type relationResp struct {
+	Field    string `json:"field"`
+	Type     string `json:"type"`
+	OnDelete string `json:"onDelete"`
 }
 
 func idToString(id any) (string, error) {
@@ -299,6 +819,11 @@ func idToString(id any) (string, error) {
 		return t, nil
 	case int:
 		return strconv.Itoa(t), nil
+	case float64:
+		if t != math.Trunc(t) {
+			return "", fmt.Errorf("invalid id: %v", id)
+		}
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
 	default:
 		return "", fmt.Errorf("invalid id type: %v", id)
 	}
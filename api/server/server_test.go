@@ -53,6 +53,33 @@ func TestServer_List(t *testing.T) {
 	assert.JSONEq(t, `[{"id": "a", "name": "123"},{"id": "b", "name": "456"}]`, string(body))
 }
 
+func TestServer_ListFilters(t *testing.T) {
+	indexedType := server.Type{Name: "pets", Id: "id", Indexes: []string{"species"}, Schema: `{"type": "object"}`}
+	store, err := datastore.NewMemory(
+		datastore.Record{Type: indexedType, Id: "1", Data: server.Object{"id": "1", "species": "cow", "legs": 4}},
+		datastore.Record{Type: indexedType, Id: "2", Data: server.Object{"id": "2", "species": "trex", "legs": 2}},
+		datastore.Record{Type: indexedType, Id: "3", Data: server.Object{"id": "3", "species": "cow", "legs": 3}},
+		datastore.Record{Type: indexedType, Id: "4", Data: server.Object{"id": "4", "species": "duck", "legs": 2}},
+	)
+	require.NoError(t, err)
+
+	url, closeFn := startServer(store, indexedType)
+	defer closeFn()
+
+	resp, err := http.Get(fmt.Sprintf("%s/pets?species=cow&_sort=id&_order=ASC", url))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "2", resp.Header.Get("X-Total-Count"))
+	assert.JSONEq(t, `[{"id": "1", "species": "cow", "legs": 4}, {"id": "3", "species": "cow", "legs": 3}]`, string(body))
+
+	body2 := getBody(t, fmt.Sprintf("%s/pets?species=cow&species=duck&legs=4", url), http.StatusOK)
+	assert.JSONEq(t, `[{"id": "1", "species": "cow", "legs": 4}]`, body2)
+
+	body3 := getBody(t, fmt.Sprintf("%s/pets?legs=2", url), http.StatusOK)
+	assert.JSONEq(t, `[{"id": "2", "species": "trex", "legs": 2}, {"id": "4", "species": "duck", "legs": 2}]`, body3)
+}
+
 func TestServer_Get(t *testing.T) {
 	store, err := datastore.NewMemory()
 	require.NoError(t, err)
@@ -110,13 +137,32 @@ func TestServer_PostValidatesSchema(t *testing.T) {
 
 	errBody, err := io.ReadAll(resp.Body)
 	require.NoError(t, err)
-	assert.JSONEq(t, `{"validationErrors": ["(root): name is required"]}`, string(errBody))
+	assert.JSONEq(t, `{"validationErrors": ["(root): missing properties: 'name'"]}`, string(errBody))
 
 	all2, err := store.List(BasicType)
 	require.NoError(t, err)
 	assert.Len(t, all2, 0)
 }
 
+func TestServer_PostRejectsDuplicateUniqueValues(t *testing.T) {
+	uniqueType := BasicType
+	uniqueType.Unique = []string{"name"}
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	require.NoError(t, store.Create(uniqueType, "1", server.Object{"id": "1", "name": "taken"}))
+
+	url, closeFn := startServer(store, uniqueType)
+	defer closeFn()
+
+	resp, err := http.Post(fmt.Sprintf("%s/%s", url, uniqueType.Name), "application/json", strings.NewReader(`{"id": "2", "name": "taken"}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	all, err := store.List(uniqueType)
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+}
+
 func TestServer_Put(t *testing.T) {
 	store, err := datastore.NewMemory()
 	require.NoError(t, err)
@@ -156,7 +202,7 @@ func TestServer_PutValidatesSchema(t *testing.T) {
 
 	errBody, err := io.ReadAll(resp.Body)
 	require.NoError(t, err)
-	assert.JSONEq(t, `{"validationErrors": ["(root): name is required"]}`, string(errBody))
+	assert.JSONEq(t, `{"validationErrors": ["(root): missing properties: 'name'"]}`, string(errBody))
 
 	updated, err := store.Get(BasicType, "1")
 	require.NoError(t, err)
@@ -224,15 +270,65 @@ type describeResp struct {
 	Types []typeResp `json:"types"`
 }
 
-func startServer(dataStore datastore.Memory, ty server.Type) (string, func()) {
+func startServer(dataStore datastore.Memory, types ...server.Type) (string, func()) {
 	r := chi.NewRouter()
 	server.Server{
 		Config: server.Config{
-			Types: []server.Type{ty},
+			Types: types,
 		},
 		DataStore: dataStore,
 	}.Start(r)
 
 	testServer := httptest.NewServer(r)
-	return testServer.URL, testServer.Close
+	return testServer.URL + "/api", testServer.Close
 }
+
+// serverOption changes the config of a server started by startConfiguredServer.
+type serverOption func(config *server.Config)
+
+func withAuth(auth server.AuthConfig) serverOption {
+	return func(config *server.Config) {
+		config.Auth = auth
+	}
+}
+
+func withAudit(sink server.AuditSink) serverOption {
+	return func(config *server.Config) {
+		config.Audit = sink
+	}
+}
+
+func withAdminAssets(dir string) serverOption {
+	return func(config *server.Config) {
+		config.AdminAssets = dir
+	}
+}
+
+func withMaxExpandDepth(depth int) serverOption {
+	return func(config *server.Config) {
+		config.MaxExpandDepth = depth
+	}
+}
+
+// startConfiguredServer starts a server for the types with the options, it is closed when the test ends.
+func startConfiguredServer(t *testing.T, dataStore server.DataProvider, types []server.Type, options ...serverOption) string {
+	config := server.Config{Types: types}
+	for _, option := range options {
+		option(&config)
+	}
+	r := chi.NewRouter()
+	require.NoError(t, server.Server{Config: config, DataStore: dataStore}.Start(r))
+
+	testServer := httptest.NewServer(r)
+	t.Cleanup(testServer.Close)
+	return testServer.URL + "/api"
+}
+
+// storeWith returns a memory store holding the records.
+func storeWith(t *testing.T, records ...datastore.Record) datastore.Memory {
+	store, err := datastore.NewMemory(records...)
+	require.NoError(t, err)
+	return store
+}
+
+var chris = datastore.Record{Type: BasicType, Id: "1", Data: server.Object{"id": "1", "name": "chris"}}
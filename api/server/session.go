@@ -0,0 +1,374 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultSessionTTL is how long admin sessions last when AuthConfig.SessionTTL isn't set.
+const DefaultSessionTTL = 12 * time.Hour
+
+const (
+	sessionCookie = "cms_session"
+	// csrfCookie holds a token scripts on the admin pages read and send back as the csrfHeader of unsafe requests,
+	// which other sites can't do, so they can't make writes with the session cookie the browser attaches.
+	csrfCookie = "cms_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// User can log in to the admin UI with a password.
+type User struct {
+	Name string
+	// PasswordHash is the bcrypt hash of the password, see HashPassword.
+	PasswordHash string
+	Permissions  map[string][]Scope
+	Roles        []string
+}
+
+// HashPassword returns the bcrypt hash of a password to put in the config.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// sessions issues and checks the signed cookies of logged in users. Sessions aren't stored, a cookie is valid
+// until it expires as long as its user is still configured and it hasn't been revoked by logging out.
+type sessions struct {
+	secret []byte
+	ttl    time.Duration
+	users  map[string]User
+	// store keeps the sessions revoked before they expire
+	store DataProvider
+	// dummyHash is compared with the passwords of unknown users, so logging in takes as long as for known ones
+	dummyHash []byte
+}
+
+type session struct {
+	Id      string `json:"id"`
+	User    string `json:"user"`
+	Expires int64  `json:"expires"`
+}
+
+// revokedType keeps the ids of sessions ended by logging out, until they would have expired.
+var revokedType = Type{Name: "_revoked", Id: "id", Schema: `{"type": "object"}`}
+
+func newSessions(config AuthConfig, store DataProvider) (*sessions, error) {
+	secret := []byte(config.SessionSecret)
+	if len(secret) == 0 {
+		// sessions won't survive a restart or be shared between instances
+		secret = make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate session secret: %w", err)
+		}
+	}
+	ttl := config.SessionTTL
+	if ttl == 0 {
+		ttl = DefaultSessionTTL
+	}
+	users := map[string]User{}
+	for _, user := range config.Users {
+		users[user.Name] = user
+	}
+	dummy, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte(dummy), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return &sessions{secret: secret, ttl: ttl, users: users, store: store, dummyHash: dummyHash}, nil
+}
+
+func (s *sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// login checks the password and returns the cookies of a new session.
+func (s *sessions) login(name string, password string, secure bool) ([]*http.Cookie, error) {
+	user, found := s.users[name]
+	hash := []byte(user.PasswordHash)
+	if !found {
+		hash = s.dummyHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !found {
+		return nil, fmt.Errorf("%w: invalid username or password", ErrUnauthorized)
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(s.ttl)
+	payload, err := json.Marshal(session{Id: id, User: user.Name, Expires: expires.Unix()})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return []*http.Cookie{
+		{Name: sessionCookie, Value: encoded + "." + s.sign(encoded), Path: "/", Expires: expires, HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode},
+		{Name: csrfCookie, Value: token, Path: "/", Expires: expires, Secure: secure, SameSite: http.SameSiteStrictMode},
+	}, nil
+}
+
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// session reads the session cookie of the request, checking its signature and that it hasn't expired or been
+// revoked.
+func (s *sessions) session(request *http.Request) (session, error) {
+	cookie, err := request.Cookie(sessionCookie)
+	if err != nil {
+		return session{}, fmt.Errorf("%w: missing credentials", ErrUnauthorized)
+	}
+	encoded, signature, found := strings.Cut(cookie.Value, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(s.sign(encoded))) {
+		return session{}, fmt.Errorf("%w: invalid session", ErrUnauthorized)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return session{}, fmt.Errorf("%w: invalid session", ErrUnauthorized)
+	}
+	var sess session
+	err = json.Unmarshal(payload, &sess)
+	if err != nil || time.Now().Unix() > sess.Expires {
+		return session{}, fmt.Errorf("%w: session expired", ErrUnauthorized)
+	}
+	if sess.Id == "" {
+		return session{}, fmt.Errorf("%w: invalid session", ErrUnauthorized)
+	}
+	_, err = s.store.Get(revokedType, sess.Id)
+	if err == nil {
+		return session{}, fmt.Errorf("%w: session ended", ErrUnauthorized)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return session{}, fmt.Errorf("unable to check session: %w", err)
+	}
+	return sess, nil
+}
+
+// user returns the user of the session cookie of the request. Unsafe requests also need the CSRF header.
+func (s *sessions) user(request *http.Request) (User, error) {
+	sess, err := s.session(request)
+	if err != nil {
+		return User{}, err
+	}
+	user, found := s.users[sess.User]
+	if !found {
+		return User{}, fmt.Errorf("%w: invalid session", ErrUnauthorized)
+	}
+
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		token, err := request.Cookie(csrfCookie)
+		header := request.Header.Get(csrfHeader)
+		if err != nil || header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(token.Value)) != 1 {
+			return User{}, fmt.Errorf("%w: missing or invalid %s header", ErrForbidden, csrfHeader)
+		}
+	}
+	return user, nil
+}
+
+// revoke ends the session of the request before it expires, on every instance, and forgets the revoked sessions
+// that have expired since.
+func (s *sessions) revoke(request *http.Request) error {
+	sess, err := s.session(request)
+	if err != nil {
+		// there is no session left to end
+		return nil
+	}
+	err = s.store.Update(revokedType, sess.Id, Object{"id": sess.Id, "expires": sess.Expires})
+	if err != nil {
+		return fmt.Errorf("unable to end session: %w", err)
+	}
+
+	revoked, err := s.store.List(revokedType)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, obj := range revoked {
+		var entry session
+		if unmarshalObject(obj, &entry) != nil || entry.Expires >= now {
+			continue
+		}
+		err = s.store.Delete(revokedType, entry.Id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func expiredCookies() []*http.Cookie {
+	return []*http.Cookie{
+		{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true},
+		{Name: csrfCookie, Value: "", Path: "/", MaxAge: -1},
+	}
+}
+
+// secureRequest reports whether the request reached the server, or the proxy in front of it, over https.
+func secureRequest(request *http.Request) bool {
+	return request.TLS != nil || request.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// safeRedirect only follows local paths, so the login page can't be used to send users to other sites.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/admin"
+	}
+	return next
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Log in</title>
+	<style>
+		body { font-family: sans-serif; display: flex; justify-content: center; margin-top: 10vh; }
+		form { display: flex; flex-direction: column; gap: 0.5em; width: 20em; }
+		.error { color: #b00020; }
+	</style>
+</head>
+<body>
+<form method="post" action="/auth/login">
+	<h1>Log in</h1>
+	{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+	<input type="hidden" name="next" value="{{.Next}}">
+	<label>Username <input name="username" autocomplete="username" required autofocus></label>
+	<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+	<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	Next  string
+	Error string
+}
+
+type loginReq struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// addSessionEndpoints serves the login page and the endpoints logging users in and out. Forms posted by the login
+// page are redirected, JSON requests get a status code.
+func (s Server) addSessionEndpoints(r chi.Router) {
+	r.Get("/auth/login", func(writer http.ResponseWriter, request *http.Request) {
+		writeLoginPage(writer, http.StatusOK, loginPageData{Next: safeRedirect(request.URL.Query().Get("next"))})
+	})
+
+	r.Post("/auth/login", func(writer http.ResponseWriter, request *http.Request) {
+		isJSON := strings.HasPrefix(request.Header.Get("Content-Type"), "application/json")
+		var req loginReq
+		next := "/admin"
+		if isJSON {
+			err := json.NewDecoder(request.Body).Decode(&req)
+			if err != nil {
+				handleError(writer, fmt.Errorf("%w: %s", ErrBadRequest, err))
+				return
+			}
+		} else {
+			err := request.ParseForm()
+			if err != nil {
+				handleError(writer, fmt.Errorf("%w: %s", ErrBadRequest, err))
+				return
+			}
+			req = loginReq{Username: request.PostForm.Get("username"), Password: request.PostForm.Get("password")}
+			next = safeRedirect(request.PostForm.Get("next"))
+		}
+
+		cookies, err := s.sessions.login(req.Username, req.Password, secureRequest(request))
+		if err != nil {
+			log.Printf("Login failed for %q: %s \n", req.Username, err)
+			if isJSON {
+				handleError(writer, err)
+			} else {
+				writeLoginPage(writer, http.StatusUnauthorized, loginPageData{Next: next, Error: "Invalid username or password"})
+			}
+			return
+		}
+		for _, cookie := range cookies {
+			http.SetCookie(writer, cookie)
+		}
+		if isJSON {
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Redirect(writer, request, next, http.StatusSeeOther)
+	})
+
+	r.Post("/auth/logout", func(writer http.ResponseWriter, request *http.Request) {
+		err := s.sessions.revoke(request)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		for _, cookie := range expiredCookies() {
+			http.SetCookie(writer, cookie)
+		}
+		if strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") {
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Redirect(writer, request, "/auth/login", http.StatusSeeOther)
+	})
+}
+
+func writeLoginPage(writer http.ResponseWriter, status int, data loginPageData) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(status)
+	err := loginPage.Execute(writer, data)
+	if err != nil {
+		log.Printf("error writing login page: %s \n", err)
+	}
+}
+
+// redirectToLogin sends browsers without a session to the login page instead of failing admin requests.
+func (s Server) redirectToLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if s.sessions == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		_, err := s.principal(request)
+		if errors.Is(err, ErrUnauthorized) {
+			http.Redirect(writer, request, "/auth/login?next="+url.QueryEscape(request.URL.Path), http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
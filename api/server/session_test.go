@@ -0,0 +1,163 @@
+package server_test
+
+import (
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/cookiejar"
+	neturl "net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionAuth lets the user chris sign in with the password hunter2.
+func sessionAuth(t *testing.T) server.AuthConfig {
+	hash, err := server.HashPassword("hunter2")
+	require.NoError(t, err)
+	return server.AuthConfig{
+		Users: []server.User{{Name: "chris", PasswordHash: hash, Permissions: map[string][]server.Scope{
+			server.AnyType: {server.ScopeRead, server.ScopeWrite, server.ScopeDelete},
+		}}},
+		SessionSecret: "secret",
+	}
+}
+
+// baseURL is the root of a server started by startConfiguredServer.
+func baseURL(url string) string {
+	return strings.TrimSuffix(url, "/api")
+}
+
+// browser returns a client keeping cookies that doesn't follow redirects.
+func browser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	return &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+}
+
+func login(t *testing.T, client *http.Client, base string, password string) *http.Response {
+	resp, err := client.PostForm(base+"/auth/login", neturl.Values{"username": {"chris"}, "password": {password}, "next": {"/admin/"}})
+	require.NoError(t, err)
+	return resp
+}
+
+func csrfToken(client *http.Client, base string) string {
+	u, _ := neturl.Parse(base)
+	for _, cookie := range client.Jar.Cookies(u) {
+		if cookie.Name == "cms_csrf" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func TestServer_RedirectsAdminToLogin(t *testing.T) {
+	base := baseURL(startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAdminAssets(t.TempDir()), withAuth(sessionAuth(t))))
+	client := browser(t)
+
+	resp, err := client.Get(base + "/admin/")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, "/auth/login?next=%2Fadmin%2F", resp.Header.Get("Location"))
+
+	resp = login(t, client, base, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, readBody(t, resp), "Invalid username or password")
+
+	resp = login(t, client, base, "hunter2")
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, "/admin/", resp.Header.Get("Location"))
+
+	resp, err = client.Get(base + "/admin/")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = client.Post(base+"/auth/logout", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	resp, err = client.Get(base + "/api/user/1")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestServer_RequiresCSRFTokenForSessionWrites(t *testing.T) {
+	base := baseURL(startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAdminAssets(t.TempDir()), withAuth(sessionAuth(t))))
+	client := browser(t)
+	require.Equal(t, http.StatusSeeOther, login(t, client, base, "hunter2").StatusCode)
+
+	resp, err := client.Get(fmt.Sprintf("%s/api/user/1", base))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = client.Post(fmt.Sprintf("%s/api/user", base), "application/json", strings.NewReader(`{"id": "2", "name": "fred"}`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/user", base), strings.NewReader(`{"id": "2", "name": "fred"}`))
+	require.NoError(t, err)
+	request.Header.Set("X-CSRF-Token", csrfToken(client, base))
+	resp, err = client.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestServer_RejectsTamperedSessions(t *testing.T) {
+	base := baseURL(startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAdminAssets(t.TempDir()), withAuth(sessionAuth(t))))
+
+	resp, err := http.Post(base+"/auth/login", "application/json", strings.NewReader(`{"username": "chris", "password": "hunter2"}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var session *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "cms_session" {
+			session = cookie
+		}
+	}
+	require.NotNil(t, session)
+	assert.True(t, session.HttpOnly)
+
+	request, err := http.NewRequest(http.MethodGet, base+"/api/user/1", nil)
+	require.NoError(t, err)
+	request.AddCookie(&http.Cookie{Name: "cms_session", Value: "x" + session.Value})
+	resp, err = http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServer_LogoutEndsTheSession(t *testing.T) {
+	base := baseURL(startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAdminAssets(t.TempDir()), withAuth(sessionAuth(t))))
+	client := browser(t)
+	require.Equal(t, http.StatusSeeOther, login(t, client, base, "hunter2").StatusCode)
+	u, err := neturl.Parse(base)
+	require.NoError(t, err)
+	cookies := client.Jar.Cookies(u)
+
+	resp, err := client.Post(base+"/auth/logout", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	request, err := http.NewRequest(http.MethodGet, base+"/api/user/1", nil)
+	require.NoError(t, err)
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	resp, err = http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "a copy of the cookie kept from before logging out is refused")
+}
+
+func TestServer_LoginChecksAPasswordForUnknownUsers(t *testing.T) {
+	base := baseURL(startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withAdminAssets(t.TempDir()), withAuth(sessionAuth(t))))
+
+	started := time.Now()
+	resp, err := http.PostForm(base+"/auth/login", neturl.Values{"username": {"nobody"}, "password": {"hunter2"}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Greater(t, time.Since(started), 10*time.Millisecond, "unknown usernames take as long as wrong passwords")
+}
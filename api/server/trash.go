@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DefaultTrashRetention is how long deleted objects stay in the trash when the type doesn't set TrashRetention.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// DefaultSweepInterval is how often expired objects are purged from the trash when Config.SweepInterval isn't set.
+const DefaultSweepInterval = time.Hour
+
+const sweeperLease = "sweeper"
+
+// Trashed is an object in the trash of its type.
+type Trashed struct {
+	Id        string    `json:"id"`
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy,omitempty"`
+	Object    Object    `json:"object"`
+}
+
+// trashType is where deleted objects of types with SoftDelete are kept until they are restored or purged.
+func (t Type) trashType() Type {
+	return Type{Name: t.Name + "/_trash", Id: "id", Schema: `{"type": "object"}`}
+}
+
+func (t Type) retention() time.Duration {
+	if t.TrashRetention == 0 {
+		return DefaultTrashRetention
+	}
+	return t.TrashRetention
+}
+
+// trash keeps the latest version of an object, its draft when it has one, in the trash of its type.
+func (s Server) trash(t Type, id string, by string) error {
+	obj, err := s.getStage(t, id, StageDraft)
+	if err != nil {
+		return err
+	}
+	entry := Object{"id": id, "deletedAt": time.Now().UTC().Format(time.RFC3339Nano), "object": obj}
+	if by != "" {
+		entry["deletedBy"] = by
+	}
+	err = s.DataStore.Update(t.trashType(), id, entry)
+	if err != nil {
+		return fmt.Errorf("unable to move %s %s to the trash: %w", t.Name, id, err)
+	}
+	return nil
+}
+
+// discard deletes an object, moving it to the trash first for types with SoftDelete. When the delete fails, e.g. as
+// it is restricted by a reference, the trash is put back as it was, keeping an object trashed earlier with the id.
+func (s Server) discard(ctx context.Context, t Type, id string) error {
+	if !t.SoftDelete {
+		return s.deleteStages(ctx, t, id)
+	}
+
+	previous, err := s.DataStore.Get(t.trashType(), id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("unable to read %s %s from the trash: %w", t.Name, id, err)
+	}
+	principal, _ := PrincipalFrom(ctx)
+	err = s.trash(t, id, principal.Name)
+	if err != nil {
+		return err
+	}
+	err = s.deleteStages(ctx, t, id)
+	if err != nil {
+		var restoreErr error
+		if previous != nil {
+			restoreErr = s.DataStore.Update(t.trashType(), id, previous)
+		} else {
+			restoreErr = s.DataStore.Delete(t.trashType(), id)
+		}
+		if restoreErr != nil {
+			log.Printf("Error putting back the trash of %s %s: %s \n", t.Name, id, restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func trashedFromObject(entry Object) (Trashed, error) {
+	var trashed Trashed
+	id, err := idToString(entry["id"])
+	if err != nil {
+		return trashed, err
+	}
+	trashed.Id = id
+	trashed.DeletedBy, _ = IndexValue(entry["deletedBy"])
+	deletedAt, _ := IndexValue(entry["deletedAt"])
+	trashed.DeletedAt, err = time.Parse(time.RFC3339Nano, deletedAt)
+	if err != nil {
+		return trashed, fmt.Errorf("unable to read deletion time of %s: %w", id, err)
+	}
+	switch obj := entry["object"].(type) {
+	case Object:
+		trashed.Object = copyObject(obj)
+	case map[string]interface{}:
+		trashed.Object = obj
+	default:
+		return trashed, fmt.Errorf("trashed %s holds no object", id)
+	}
+	return trashed, nil
+}
+
+func (s Server) getTrashed(ctx context.Context, t Type, id string) (Trashed, error) {
+	entry, err := s.DataStore.Get(t.trashType(), id)
+	if err != nil {
+		return Trashed{}, fmt.Errorf("no %s %s in the trash: %w", t.Name, id, err)
+	}
+	trashed, err := trashedFromObject(entry)
+	if err != nil {
+		return Trashed{}, err
+	}
+	if !s.owns(ctx, t, trashed.Object) {
+		return Trashed{}, fmt.Errorf("no %s %s in the trash: %w", t.Name, id, ErrNotFound)
+	}
+	return trashed, nil
+}
+
+func (s Server) listTrash(t Type) ([]Trashed, error) {
+	entries, err := s.DataStore.List(t.trashType())
+	if err != nil {
+		return nil, err
+	}
+	trash := make([]Trashed, 0, len(entries))
+	for _, entry := range entries {
+		trashed, err := trashedFromObject(entry)
+		if err != nil {
+			return nil, err
+		}
+		trash = append(trash, trashed)
+	}
+	return trash, nil
+}
+
+// RunSweeper purges objects kept in the trash for longer than their type's retention, every Config.SweepInterval
+// until the context is done. Like RunScheduler it runs on every instance, only the one holding the lease sweeps.
+func (s *Server) RunSweeper(ctx context.Context) {
+	softDeletes := false
+	for _, t := range s.Config.Types {
+		softDeletes = softDeletes || t.SoftDelete
+	}
+	if !softDeletes {
+		return
+	}
+	interval := s.Config.SweepInterval
+	if interval == 0 {
+		interval = DefaultSweepInterval
+	}
+	s.runLeased(ctx, sweeperLease, interval, 0, s.sweep)
+}
+
+func (s Server) sweep(now time.Time, renew func() bool) error {
+	for _, t := range s.Config.Types {
+		if !t.SoftDelete {
+			continue
+		}
+		trash, err := s.listTrash(t)
+		if err != nil {
+			return err
+		}
+		for _, trashed := range trash {
+			if now.Sub(trashed.DeletedAt) < t.retention() {
+				continue
+			}
+			if !renew() {
+				return nil
+			}
+			err = s.purge(t, trashed.Id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// purge removes an object from the trash along with the versions kept of each of its stages.
+func (s Server) purge(t Type, id string) error {
+	err := s.DataStore.Delete(t.trashType(), id)
+	if err != nil {
+		return fmt.Errorf("unable to purge %s %s: %w", t.Name, id, err)
+	}
+	stages := []Type{t}
+	if t.hasDrafts() {
+		stages = append(stages, t.draftType())
+	}
+	for _, stage := range stages {
+		err = s.forget(stage, id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("unable to purge history of %s %s: %w", t.Name, id, err)
+		}
+	}
+	return nil
+}
+
+func (s Server) addTrashEndpoints(r chi.Router, t Type, validator Validator) {
+	r.With(s.authorize(ScopeRead, t.Name)).Get(fmt.Sprintf("/%s/_trash", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+		trash, err := s.listTrash(t)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		owned := make([]Trashed, 0, len(trash))
+		for _, trashed := range trash {
+			if s.owns(request.Context(), t, trashed.Object) {
+				s.hide(request.Context(), t, []Object{trashed.Object}, nil)
+				owned = append(owned, trashed)
+			}
+		}
+		writer.Header().Set("X-Total-Count", fmt.Sprintf("%d", len(owned)))
+		writeJSON(writer, owned)
+	})
+
+	// restoring creates the object again, so it is checked like a create against the current schema
+	r.With(s.authorize(ScopeDelete, t.Name), s.authorize(ScopeWrite, t.Name)).Post(fmt.Sprintf("/%s/_trash/{id}/_restore", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+		id := chi.URLParam(request, "id")
+		trashed, err := s.getTrashed(request.Context(), t, id)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+
+		_, err = s.getStage(t, id, StageDraft)
+		if err == nil {
+			handleError(writer, fmt.Errorf("%w: %s %s exists, it can't be restored over", ErrConflict, t.Name, id))
+			return
+		}
+		if !errors.Is(err, ErrNotFound) {
+			handleError(writer, err)
+			return
+		}
+		_, err = s.authorizeWrite(request.Context(), t, "", trashed.Object)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		b, err := json.Marshal(trashed.Object)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		valid, validationErrors, err := validator.Validate(string(b))
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		if !valid {
+			handleValidationError(writer, validationErrors)
+			return
+		}
+		referenceErrors, err := s.checkReferences(t, trashed.Object)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		if len(referenceErrors) > 0 {
+			handleValidationError(writer, referenceErrors)
+			return
+		}
+
+		err = s.create(t.writeType(), id, trashed.Object)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		err = s.DataStore.Delete(t.trashType(), id)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		s.audit(request.Context(), t, id, OpRestore, nil, trashed.Object)
+
+		restored := copyObject(trashed.Object)
+		s.hide(request.Context(), t, []Object{restored}, nil)
+		writeJSON(writer, restored)
+	})
+
+	r.With(s.authorize(ScopeDelete, t.Name)).Delete(fmt.Sprintf("/%s/_trash/{id}", t.Name), func(writer http.ResponseWriter, request *http.Request) {
+		id := chi.URLParam(request, "id")
+		trashed, err := s.getTrashed(request.Context(), t, id)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		err = s.purge(t, id)
+		if err != nil {
+			handleError(writer, err)
+			return
+		}
+		s.audit(request.Context(), t, id, OpPurge, trashed.Object, nil)
+		writer.WriteHeader(http.StatusNoContent)
+	})
+}
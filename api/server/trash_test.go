@@ -0,0 +1,163 @@
+package server_test
+
+import (
+	"context"
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var DocsType = server.Type{Name: "docs", Id: "id", SoftDelete: true, Schema:
+// language=json
+`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"title": { "type": "string" }
+	}
+}`}
+
+func TestServer_SoftDeleteMovesObjectsToTrash(t *testing.T) {
+	store, err := datastore.NewMemory(datastore.Record{Type: DocsType, Id: "1", Data: server.Object{"id": "1", "title": "Plan"}})
+	require.NoError(t, err)
+	url, closeFn := startServer(store, DocsType)
+	defer closeFn()
+
+	resp := authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	getBody(t, fmt.Sprintf("%s/docs/1", url), http.StatusNotFound)
+	assert.JSONEq(t, `[]`, getBody(t, fmt.Sprintf("%s/docs", url), http.StatusOK))
+	trash := getBody(t, fmt.Sprintf("%s/docs/_trash", url), http.StatusOK)
+	assert.Contains(t, trash, `"object":{"id":"1","title":"Plan"}`)
+
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs/_trash/1/_restore", url), "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"id": "1", "title": "Plan"}`, readBody(t, resp))
+	assert.JSONEq(t, `{"id": "1", "title": "Plan"}`, getBody(t, fmt.Sprintf("%s/docs/1", url), http.StatusOK))
+	assert.JSONEq(t, `[]`, getBody(t, fmt.Sprintf("%s/docs/_trash", url), http.StatusOK))
+
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/_trash/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.JSONEq(t, `[]`, getBody(t, fmt.Sprintf("%s/docs/_trash", url), http.StatusOK))
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs/_trash/1/_restore", url), "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServer_RestoreDoesNotOverwrite(t *testing.T) {
+	store, err := datastore.NewMemory(datastore.Record{Type: DocsType, Id: "1", Data: server.Object{"id": "1", "title": "Plan"}})
+	require.NoError(t, err)
+	url, closeFn := startServer(store, DocsType)
+	defer closeFn()
+
+	resp := authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/docs/1", url), `{"id": "1", "title": "New plan"}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs/_trash/1/_restore", url), "", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestServer_FailedDeleteKeepsTrash(t *testing.T) {
+	comments := server.Type{Name: "comments", Id: "id", Schema:
+	// language=json
+	`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"doc": { "type": "string", "x-ref": "docs" }
+	}
+}`}
+	store, err := datastore.NewMemory(datastore.Record{Type: DocsType, Id: "1", Data: server.Object{"id": "1", "title": "Plan"}})
+	require.NoError(t, err)
+	url, closeFn := startServer(store, DocsType, comments)
+	defer closeFn()
+
+	resp := authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/docs/1", url), `{"id": "1", "title": "New plan"}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/comments", url), `{"id": "1", "doc": "1"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/1", url), "", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Contains(t, getBody(t, fmt.Sprintf("%s/docs/_trash", url), http.StatusOK), `"object":{"id":"1","title":"Plan"}`)
+}
+
+func TestServer_SweeperPurgesExpiredTrash(t *testing.T) {
+	docs := DocsType
+	docs.TrashRetention = time.Millisecond
+	store, err := datastore.NewMemory(datastore.Record{Type: docs, Id: "1", Data: server.Object{"id": "1", "title": "Plan"}})
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	s, err := server.New(server.Config{Types: []server.Type{docs}, SweepInterval: 10 * time.Millisecond}, store)
+	require.NoError(t, err)
+	require.NoError(t, s.Start(r))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.RunSweeper(ctx)
+	testServer := httptest.NewServer(r)
+	defer testServer.Close()
+	url := testServer.URL + "/api"
+
+	resp := authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Eventually(t, func() bool {
+		trash, err := store.List(server.Type{Name: "docs/_trash"})
+		return err == nil && len(trash) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServer_RestoreIsCheckedLikeACreate(t *testing.T) {
+	store, err := datastore.NewMemory(
+		datastore.Record{Type: DocsType, Id: "1", Data: server.Object{"id": "1", "title": "Plan"}},
+		datastore.Record{Type: DocsType, Id: "2", Data: server.Object{"id": "2", "title": 2}},
+	)
+	require.NoError(t, err)
+	auth := server.AuthConfig{APIKeys: append([]server.APIKey{
+		{Name: "cleaner", Hash: server.HashKey("clean-key"), Permissions: map[string][]server.Scope{"docs": {server.ScopeRead, server.ScopeDelete}}},
+	}, apiKeys.APIKeys...)}
+	url := startConfiguredServer(t, store, []server.Type{DocsType}, withAuth(auth))
+
+	resp := authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/1", url), "", "clean-key")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs/_trash/1/_restore", url), "", "clean-key")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "restoring writes the object")
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs/_trash/1/_restore", url), "", "admin-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/2", url), "", "admin-key")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs/_trash/2/_restore", url), "", "admin-key")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "the object doesn't match the schema")
+}
+
+func TestServer_PurgeRemovesHistory(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	url, closeFn := startServer(store, DocsType)
+	defer closeFn()
+
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs", url), `{"id": "1", "title": "Plan"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	getBody(t, fmt.Sprintf("%s/docs/1/_history", url), http.StatusOK)
+
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/docs/_trash/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	getBody(t, fmt.Sprintf("%s/docs/1/_history", url), http.StatusNotFound)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/xeipuuv/gojsonschema"
+	"io"
+	"strings"
+)
+
+// Validator checks documents against a single compiled schema.
+type Validator interface {
+	Validate(content string) (bool, []string, error)
+}
+
+// NewValidator compiles schema with the implementation matching its $schema keyword.
+// Draft-04 to draft-07 schemas (and schemas without $schema) are handled by gojsonschema,
+// draft 2019-09 and 2020-12 schemas by a validator implementing those drafts.
+func NewValidator(schema string) (Validator, error) {
+	var meta struct {
+		Schema string `json:"$schema"`
+	}
+	err := json.Unmarshal([]byte(schema), &meta)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse schema: %w", err)
+	}
+
+	draft := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(meta.Schema, "https://"), "http://"), "#")
+	switch draft {
+	case "", "json-schema.org/draft-04/schema", "json-schema.org/draft-06/schema", "json-schema.org/draft-07/schema":
+		return newLegacyValidator(schema)
+	case "json-schema.org/draft/2019-09/schema":
+		return newModernValidator(schema, jsonschema.Draft2019)
+	case "json-schema.org/draft/2020-12/schema":
+		return newModernValidator(schema, jsonschema.Draft2020)
+	default:
+		return nil, fmt.Errorf("unsupported $schema: %s", meta.Schema)
+	}
+}
+
+type legacyValidator struct {
+	schema *gojsonschema.Schema
+}
+
+func newLegacyValidator(schema string) (legacyValidator, error) {
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+	if err != nil {
+		return legacyValidator{}, fmt.Errorf("unable to compile schema: %w", err)
+	}
+	return legacyValidator{schema: compiled}, nil
+}
+
+func (v legacyValidator) Validate(content string) (bool, []string, error) {
+	result, err := v.schema.Validate(gojsonschema.NewStringLoader(content))
+	if err != nil {
+		return false, nil, err
+	}
+
+	errs := make([]string, 0)
+	for _, resultError := range result.Errors() {
+		errs = append(errs, resultError.String())
+	}
+
+	return result.Valid(), errs, nil
+}
+
+type modernValidator struct {
+	schema *jsonschema.Schema
+}
+
+func newModernValidator(schema string, draft *jsonschema.Draft) (modernValidator, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = draft
+	compiler.AssertFormat = true
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("unable to load %s: external references are not supported", url)
+	}
+
+	err := compiler.AddResource("schema.json", strings.NewReader(schema))
+	if err != nil {
+		return modernValidator{}, fmt.Errorf("unable to load schema: %w", err)
+	}
+	compiled, err := compiler.Compile("schema.json")
+	if err != nil {
+		return modernValidator{}, fmt.Errorf("unable to compile schema: %w", err)
+	}
+	return modernValidator{schema: compiled}, nil
+}
+
+func (v modernValidator) Validate(content string) (bool, []string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(content)))
+	decoder.UseNumber()
+	var doc interface{}
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return false, nil, err
+	}
+
+	err = v.schema.Validate(doc)
+	if err == nil {
+		return true, []string{}, nil
+	}
+	validationError, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return false, nil, err
+	}
+
+	errs := make([]string, 0)
+	for _, leaf := range leafErrors(validationError) {
+		errs = append(errs, fmt.Sprintf("%s: %s", instanceField(leaf.InstanceLocation), leaf.Message))
+	}
+	return false, errs, nil
+}
+
+// leafErrors flattens the error tree to the errors that caused validation to fail.
+func leafErrors(e *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(e.Causes) == 0 {
+		return []*jsonschema.ValidationError{e}
+	}
+	leaves := make([]*jsonschema.ValidationError, 0)
+	for _, cause := range e.Causes {
+		leaves = append(leaves, leafErrors(cause)...)
+	}
+	return leaves
+}
+
+// instanceField formats a JSON pointer the same way gojsonschema names fields, e.g. /phone/home as phone.home.
+func instanceField(pointer string) string {
+	if pointer == "" {
+		return "(root)"
+	}
+	return strings.ReplaceAll(strings.TrimPrefix(pointer, "/"), "/", ".")
+}
@@ -0,0 +1,85 @@
+package server_test
+
+import (
+	"crswty.com/cms/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestValidator_Draft2020Keywords(t *testing.T) {
+	validator, err := server.NewValidator(
+		// language=json
+		`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"$defs": {
+		"phone": { "type": "object", "properties": { "home": { "type": "number" } }, "unevaluatedProperties": false }
+	},
+	"properties": {
+		"id": { "type": "string" },
+		"email": { "type": "string", "format": "email" },
+		"verified": { "type": "boolean" },
+		"phone": { "$ref": "#/$defs/phone" }
+	},
+	"dependentRequired": { "verified": ["email"] },
+	"unevaluatedProperties": false
+}`)
+	require.NoError(t, err)
+
+	valid, errs, err := validator.Validate(`{"id": "1", "email": "a@example.com", "verified": true, "phone": {"home": 123}}`)
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Empty(t, errs)
+
+	valid, errs, err = validator.Validate(`{"id": "1", "verified": true}`)
+	require.NoError(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, []string{"(root): property 'email' is required, if 'verified' property exists"}, errs)
+
+	valid, errs, err = validator.Validate(`{"id": "1", "other": 1}`)
+	require.NoError(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, []string{"other: not allowed"}, errs)
+
+	valid, errs, err = validator.Validate(`{"id": "1", "phone": {"home": "123"}}`)
+	require.NoError(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, []string{"phone.home: expected number, but got string"}, errs)
+
+	valid, _, err = validator.Validate(`{"id": "1", "email": "not an email"}`)
+	require.NoError(t, err)
+	assert.False(t, valid)
+}
+
+func TestValidator_Draft07(t *testing.T) {
+	validator, err := server.NewValidator(
+		// language=json
+		`{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type": "object",
+	"required": ["name"],
+	"properties": { "name": { "type": "string" } }
+}`)
+	require.NoError(t, err)
+
+	valid, errs, err := validator.Validate(`{"id": "1"}`)
+	require.NoError(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, []string{"(root): name is required"}, errs)
+}
+
+func TestValidator_DefaultsToDraft07(t *testing.T) {
+	validator, err := server.NewValidator(`{"type": "object", "required": ["name"]}`)
+	require.NoError(t, err)
+
+	valid, errs, err := validator.Validate(`{}`)
+	require.NoError(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, []string{"(root): name is required"}, errs)
+}
+
+func TestValidator_RejectsUnknownDraft(t *testing.T) {
+	_, err := server.NewValidator(`{"$schema": "https://example.com/my-schema"}`)
+	assert.Error(t, err)
+}
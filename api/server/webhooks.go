@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultWebhookInterval is how often due deliveries are sent when Config.WebhookInterval isn't set.
+	DefaultWebhookInterval = 5 * time.Second
+	// DefaultWebhookBackoff is the delay before the first retry of a failed delivery, it doubles with every attempt.
+	DefaultWebhookBackoff = 10 * time.Second
+	// DefaultWebhookAttempts is how often a delivery is attempted before it is given up.
+	DefaultWebhookAttempts = 8
+	// maxWebhookBackoff caps the delay between attempts.
+	maxWebhookBackoff = time.Hour
+	// deliveryRetention is how long finished deliveries stay in the delivery log.
+	deliveryRetention = 7 * 24 * time.Hour
+	webhookLease      = "webhooks"
+)
+
+// Delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is called with the events of Types, all types when it has none, whose operation is in Events, or any
+// operation. Changes to drafts don't call webhooks, publishing them does. Payloads are signed with Secret.
+type Webhook struct {
+	Name   string
+	URL    string
+	Secret string
+	Types  []string
+	Events []string
+}
+
+func (w Webhook) wants(e Event) bool {
+	return e.Stage == "" &&
+		(len(w.Types) == 0 || contains(w.Types, e.Type)) &&
+		(len(w.Events) == 0 || contains(w.Events, e.Operation))
+}
+
+// Delivery is an event queued for a webhook, it is kept in the provider until it is delivered or given up.
+type Delivery struct {
+	Id          string     `json:"id"`
+	Webhook     string     `json:"webhook"`
+	Event       Event      `json:"event"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt time.Time  `json:"nextAttempt"`
+	LastStatus  int        `json:"lastStatus,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	Created     time.Time  `json:"created"`
+	Finished    *time.Time `json:"finished,omitempty"`
+}
+
+// deliveriesType is the durable delivery queue and log, indexed by status so pending deliveries are found quickly.
+var deliveriesType = Type{Name: "_deliveries", Id: "id", Indexes: []string{"status"}, Schema: `{"type": "object"}`}
+
+func marshalObject(v interface{}) (Object, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var obj Object
+	err = json.Unmarshal(b, &obj)
+	return obj, err
+}
+
+func unmarshalObject(obj Object, v interface{}) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Sign returns the signature of a webhook payload sent in the X-CMS-Signature header, receivers compute it from
+// the body and their secret to check the payload came from the cms.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s Server) webhook(name string) (Webhook, bool) {
+	for _, w := range s.Config.Webhooks {
+		if w.Name == name {
+			return w, true
+		}
+	}
+	return Webhook{}, false
+}
+
+// RunWebhooks queues a delivery for every event a webhook wants and sends the due deliveries, every
+// Config.WebhookInterval, until the context is done. Every instance queues the events of the writes it handles, or
+// RunOutbox does with the outbox on, only the one holding the lease sends them.
+func (s *Server) RunWebhooks(ctx context.Context) {
+	if len(s.Config.Webhooks) == 0 {
+		return
+	}
+	interval := s.Config.WebhookInterval
+	if interval == 0 {
+		interval = DefaultWebhookInterval
+	}
+	if !s.Config.Outbox {
+		go s.follow(ctx, "webhooks", func(e Event) {
+			if err := s.queue(e); err != nil {
+				log.Printf("Error queueing event: %s \n", err)
+			}
+		})
+	}
+	s.runLeased(ctx, webhookLease, interval, webhookClient.Timeout, s.deliver)
+}
+
+// queue adds a delivery for every webhook wanting the event. Events from the outbox are queued under ids made from
+// their key, so queueing one again doesn't deliver it twice.
+func (s Server) queue(e Event) error {
+	for _, w := range s.Config.Webhooks {
+		if !w.wants(e) {
+			continue
+		}
+		now := time.Now().UTC()
+		d := Delivery{Id: newSortableId(now), Webhook: w.Name, Event: e, Status: DeliveryPending, NextAttempt: now, Created: now}
+		if e.Key != "" {
+			d.Id = e.Key + "-" + w.Name
+			_, err := s.DataStore.Get(deliveriesType, d.Id)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("unable to check delivery %s: %w", d.Id, err)
+			}
+		}
+		obj, err := marshalObject(d)
+		if err == nil {
+			err = s.DataStore.Create(deliveriesType, d.Id, obj)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to queue event %d for webhook %s: %w", e.Id, w.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s Server) deliveries(f filters) ([]Delivery, error) {
+	objs, err := s.list(deliveriesType, f)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]Delivery, 0, len(objs))
+	for _, obj := range objs {
+		var d Delivery
+		err = unmarshalObject(obj, &d)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read delivery %v: %w", obj["id"], err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].Id < deliveries[j].Id
+	})
+	return deliveries, nil
+}
+
+// deliver sends the pending deliveries that are due, oldest first, and purges finished ones from the log.
+func (s Server) deliver(now time.Time, renew func() bool) error {
+	pending, err := s.deliveries(filters{"status": {DeliveryPending}})
+	if err != nil {
+		return err
+	}
+	for _, d := range pending {
+		if d.NextAttempt.After(now) {
+			continue
+		}
+		if !renew() {
+			return nil
+		}
+		s.attempt(&d, now)
+		obj, err := marshalObject(d)
+		if err != nil {
+			return err
+		}
+		err = s.DataStore.Update(deliveriesType, d.Id, obj)
+		if err != nil {
+			return fmt.Errorf("unable to update delivery %s: %w", d.Id, err)
+		}
+	}
+
+	finished, err := s.deliveries(filters{"status": {DeliveryDelivered, DeliveryFailed}})
+	if err != nil {
+		return err
+	}
+	for _, d := range finished {
+		if d.Finished != nil && now.Sub(*d.Finished) > deliveryRetention {
+			err = s.DataStore.Delete(deliveriesType, d.Id)
+			if err != nil {
+				return fmt.Errorf("unable to purge delivery %s: %w", d.Id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// attempt posts the event to the webhook, scheduling a retry with exponential backoff when it isn't accepted.
+func (s Server) attempt(d *Delivery, now time.Time) {
+	d.Attempts++
+	w, found := s.webhook(d.Webhook)
+	if !found {
+		d.Status = DeliveryFailed
+		d.LastError = "webhook is no longer configured"
+		d.Finished = &now
+		return
+	}
+
+	d.LastStatus, d.LastError = 0, ""
+	err := s.post(w, *d)
+	if err == nil {
+		d.Status = DeliveryDelivered
+		d.Finished = &now
+		return
+	}
+	d.LastError = err.Error()
+	if status, ok := err.(webhookStatus); ok {
+		d.LastStatus = int(status)
+	}
+
+	attempts := s.Config.WebhookAttempts
+	if attempts == 0 {
+		attempts = DefaultWebhookAttempts
+	}
+	if d.Attempts >= attempts {
+		d.Status = DeliveryFailed
+		d.Finished = &now
+		return
+	}
+	backoff := s.Config.WebhookBackoff
+	if backoff == 0 {
+		backoff = DefaultWebhookBackoff
+	}
+	delay := time.Duration(math.Min(float64(backoff)*math.Pow(2, float64(d.Attempts-1)), float64(maxWebhookBackoff)))
+	d.NextAttempt = now.Add(delay)
+}
+
+// webhookStatus is the status of a response that didn't accept a delivery.
+type webhookStatus int
+
+func (w webhookStatus) Error() string {
+	return fmt.Sprintf("webhook responded with %d %s", int(w), http.StatusText(int(w)))
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (s Server) post(w Webhook, d Delivery) error {
+	payload, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-CMS-Event", d.Event.Operation)
+	request.Header.Set("X-CMS-Delivery", d.Id)
+	request.Header.Set("X-CMS-Signature", Sign(w.Secret, payload))
+
+	resp, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webhookStatus(resp.StatusCode)
+	}
+	return nil
+}
+
+// listDeliveries serves the delivery log of the events of types the principal administers, newest first.
+func (s Server) listDeliveries(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	f := filters{}
+	for _, field := range []string{"webhook", "status"} {
+		if values := splitParams(query[field]); len(values) > 0 {
+			f[field] = values
+		}
+	}
+	limit := DefaultAuditLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			handleError(writer, fmt.Errorf("%w: invalid limit %s", ErrBadRequest, value))
+			return
+		}
+	}
+
+	deliveries, err := s.deliveries(f)
+	if err != nil {
+		handleError(writer, err)
+		return
+	}
+	visible := make([]Delivery, 0)
+	for i := len(deliveries) - 1; i >= 0 && len(visible) < limit; i-- {
+		if s.can(request.Context(), deliveries[i].Event.Type, ScopeAdmin) == nil {
+			visible = append(visible, deliveries[i])
+		}
+	}
+	writer.Header().Set("X-Total-Count", fmt.Sprintf("%d", len(visible)))
+	writeJSON(writer, visible)
+}
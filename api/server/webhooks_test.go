@@ -0,0 +1,195 @@
+package server_test
+
+import (
+	"context"
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receivedHook struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+// hookReceiver fails the first requests it gets, then accepts them.
+func hookReceiver(t *testing.T, failures int) (string, func() []receivedHook) {
+	lock := &sync.Mutex{}
+	received := make([]receivedHook, 0)
+	receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(request.Body)
+		require.NoError(t, err)
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, receivedHook{event: request.Header.Get("X-CMS-Event"), signature: request.Header.Get("X-CMS-Signature"), body: body})
+		if len(received) <= failures {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver.URL, func() []receivedHook {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]receivedHook{}, received...)
+	}
+}
+
+func TestServer_WebhooksDeliverSignedEventsWithRetries(t *testing.T) {
+	flakyUrl, flakyReceived := hookReceiver(t, 2)
+	brokenUrl, brokenReceived := hookReceiver(t, 100)
+
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	r := chi.NewRouter()
+	s, err := server.New(server.Config{
+		Types: []server.Type{BasicType, DocsType},
+		Webhooks: []server.Webhook{
+			{Name: "rebuild", URL: flakyUrl, Secret: "s3cret", Types: []string{"docs"}, Events: []string{server.OpCreate}},
+			{Name: "sync", URL: brokenUrl, Secret: "s3cret", Events: []string{server.OpDelete}},
+		},
+		WebhookInterval: 10 * time.Millisecond,
+		WebhookBackoff:  time.Millisecond,
+		WebhookAttempts: 3,
+	}, store)
+	require.NoError(t, err)
+	require.NoError(t, s.Start(r))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.RunWebhooks(ctx)
+	testServer := httptest.NewServer(r)
+	t.Cleanup(testServer.Close)
+	url := testServer.URL + "/api"
+
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs", url), `{"id": "1", "title": "Plan"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodPut, fmt.Sprintf("%s/docs/1", url), `{"id": "1", "title": "New plan"}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "1", "name": "chris"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodDelete, fmt.Sprintf("%s/user/1", url), "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	require.Eventually(t, func() bool {
+		return len(flakyReceived()) == 3 && len(brokenReceived()) == 3
+	}, 2*time.Second, 10*time.Millisecond)
+
+	for _, hook := range flakyReceived() {
+		assert.Equal(t, "create", hook.event)
+		assert.Equal(t, server.Sign("s3cret", hook.body), hook.signature)
+		var event server.Event
+		require.NoError(t, json.Unmarshal(hook.body, &event))
+		assert.Equal(t, server.Object{"id": "1", "title": "Plan"}, event.Object)
+	}
+
+	var deliveries []server.Delivery
+	require.Eventually(t, func() bool {
+		deliveries = nil
+		require.NoError(t, json.Unmarshal([]byte(getBody(t, fmt.Sprintf("%s/_webhooks/deliveries", url), http.StatusOK)), &deliveries))
+		return len(deliveries) == 2 && deliveries[0].Status != server.DeliveryPending
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "sync", deliveries[0].Webhook)
+	assert.Equal(t, server.DeliveryFailed, deliveries[0].Status)
+	assert.Equal(t, 3, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusInternalServerError, deliveries[0].LastStatus)
+	assert.Equal(t, "rebuild", deliveries[1].Webhook)
+	assert.Equal(t, server.DeliveryDelivered, deliveries[1].Status)
+	assert.Equal(t, 3, deliveries[1].Attempts)
+
+	body := getBody(t, fmt.Sprintf("%s/_webhooks/deliveries?status=delivered", url), http.StatusOK)
+	assert.Contains(t, body, `"webhook":"rebuild"`)
+	assert.NotContains(t, body, `"webhook":"sync"`)
+}
+
+func TestServer_SlowWebhooksAreOnlySentByOneInstance(t *testing.T) {
+	lock := &sync.Mutex{}
+	received := map[string]int{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		received[request.Header.Get("X-CMS-Delivery")]++
+	}))
+	t.Cleanup(receiver.Close)
+
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	urls := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		r := chi.NewRouter()
+		s, err := server.New(server.Config{
+			Types:           []server.Type{BasicType},
+			Webhooks:        []server.Webhook{{Name: "slow", URL: receiver.URL, Secret: "s3cret"}},
+			WebhookInterval: 10 * time.Millisecond,
+		}, store)
+		require.NoError(t, err)
+		require.NoError(t, s.Start(r))
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go s.RunWebhooks(ctx)
+		testServer := httptest.NewServer(r)
+		t.Cleanup(testServer.Close)
+		urls = append(urls, testServer.URL+"/api")
+	}
+
+	for i := 1; i <= 4; i++ {
+		resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", urls[i%2]), fmt.Sprintf(`{"id": "%d", "name": "chris"}`, i), "")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == 4
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	for id, count := range received {
+		assert.Equal(t, 1, count, "delivery %s", id)
+	}
+}
+
+func TestServer_PublishingCallsWebhooksOnce(t *testing.T) {
+	hookUrl, received := hookReceiver(t, 0)
+
+	store, err := datastore.NewMemory(datastore.Record{Type: PagesType, Id: "1", Data: server.Object{"id": "1", "title": "Home"}})
+	require.NoError(t, err)
+	r := chi.NewRouter()
+	s, err := server.New(server.Config{
+		Types:           []server.Type{PagesType},
+		Webhooks:        []server.Webhook{{Name: "rebuild", URL: hookUrl, Secret: "s3cret"}},
+		WebhookInterval: 10 * time.Millisecond,
+	}, store)
+	require.NoError(t, err)
+	require.NoError(t, s.Start(r))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.RunWebhooks(ctx)
+	testServer := httptest.NewServer(r)
+	t.Cleanup(testServer.Close)
+	url := testServer.URL + "/api"
+
+	resp := authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/1", url), `{"id": "1", "title": "Welcome"}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/pages/1/_publish", url), "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Eventually(t, func() bool {
+		return len(received()) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	hooks := received()
+	require.Len(t, hooks, 1)
+	assert.Equal(t, "publish", hooks[0].event)
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Operations of messages sent over a WebSocket, besides the write operations create, update, delete and publish.
+const (
+	wsSubscribe    = "subscribe"
+	wsUnsubscribe  = "unsubscribe"
+	wsSubscribed   = "subscribed"
+	wsUnsubscribed = "unsubscribed"
+	wsEvent        = "event"
+	wsResult       = "result"
+	wsError        = "error"
+)
+
+// wsCredentialCheck is how often the credentials a WebSocket was opened with are checked again, it is closed once
+// they have expired or been revoked.
+const wsCredentialCheck = time.Minute
+
+// upgrader accepts WebSockets from pages served by the same host only, so session cookies can't be used by
+// other sites to open one.
+var upgrader = websocket.Upgrader{}
+
+// wsRequest is a message sent by a client. Id is chosen by the client and returned with the reply, for subscriptions
+// it also identifies the subscription in the events sent.
+type wsRequest struct {
+	Op       string   `json:"op"`
+	Id       string   `json:"id"`
+	Types    []string `json:"types,omitempty"`
+	Filter   string   `json:"filter,omitempty"`
+	Type     string   `json:"type,omitempty"`
+	ObjectId string   `json:"objectId,omitempty"`
+	Object   Object   `json:"object,omitempty"`
+}
+
+type wsReply struct {
+	Op      string          `json:"op"`
+	Id      string          `json:"id,omitempty"`
+	Status  int             `json:"status,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Event   *Event          `json:"event,omitempty"`
+}
+
+// subscription selects the events of some types, all readable ones when it has none, whose objects match filters.
+type subscription struct {
+	types   []string
+	filters filters
+}
+
+func (sub subscription) matches(e Event) bool {
+	if len(sub.types) > 0 && !contains(sub.types, e.Type) {
+		return false
+	}
+	return len(sub.filters) == 0 || (e.subject() != nil && sub.filters.matches(e.subject()))
+}
+
+type wsClient struct {
+	s       Server
+	conn    *websocket.Conn
+	request *http.Request
+	// root routes the writes sent by the client, so they go through the same handlers as the REST api
+	root http.Handler
+
+	lock          *sync.Mutex
+	subscriptions map[string]subscription
+	// done is closed once the client has gone
+	done chan struct{}
+}
+
+// serveWebSocket upgrades the request to a WebSocket, over which the client subscribes to events and writes objects
+// with the permissions of the principal that opened it.
+func (s Server) serveWebSocket(root http.Handler) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		conn, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			// the upgrader has already replied
+			return
+		}
+		defer conn.Close()
+
+		c := &wsClient{s: s, conn: conn, request: request, root: root, lock: &sync.Mutex{}, subscriptions: map[string]subscription{}, done: make(chan struct{})}
+		_, events, _ := s.events.subscribe(0)
+		defer s.events.unsubscribe(events)
+		defer close(c.done)
+		go c.forward(events)
+		go c.watch(wsCredentialCheck)
+
+		for {
+			var message wsRequest
+			err = conn.ReadJSON(&message)
+			if err != nil {
+				if _, closed := err.(*websocket.CloseError); !closed {
+					log.Printf("Error reading from websocket: %s \n", err)
+				}
+				return
+			}
+			c.handle(message)
+		}
+	}
+}
+
+// forward sends the events matching the subscriptions of the client, until the bus stops sending them.
+func (c *wsClient) forward(events chan Event) {
+	for e := range events {
+		e, ok := c.s.visible(c.request.Context(), e)
+		if !ok {
+			continue
+		}
+		c.lock.Lock()
+		ids := make([]string, 0)
+		for id, sub := range c.subscriptions {
+			if sub.matches(e) {
+				ids = append(ids, id)
+			}
+		}
+		c.lock.Unlock()
+		for _, id := range ids {
+			c.send(wsReply{Op: wsEvent, Id: id, Event: &e})
+		}
+	}
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	// dropped by the bus for falling behind
+	c.send(wsReply{Op: wsError, Status: http.StatusServiceUnavailable, Message: "events were missed, resubscribe"})
+	_ = c.conn.Close()
+}
+
+// watch closes the connection once the credentials it was opened with are no longer accepted.
+func (c *wsClient) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if _, err := c.authenticate(); err != nil {
+				c.fail("", err)
+				_ = c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// authenticate checks the credentials the connection was opened with again, returning a context with the principal.
+func (c *wsClient) authenticate() (context.Context, error) {
+	ctx := c.request.Context()
+	if !c.s.authEnabled() {
+		return ctx, nil
+	}
+	principal, err := c.s.principal(c.request)
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, principalKey{}, principal), nil
+}
+
+func (c *wsClient) send(reply wsReply) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.conn.WriteJSON(reply)
+	if err != nil {
+		log.Printf("Error writing to websocket: %s \n", err)
+	}
+}
+
+func (c *wsClient) fail(id string, err error) {
+	c.send(wsReply{Op: wsError, Id: id, Status: errorStatus(err), Message: err.Error()})
+}
+
+func (c *wsClient) handle(message wsRequest) {
+	switch message.Op {
+	case wsSubscribe:
+		sub, err := c.subscription(message)
+		if err != nil {
+			c.fail(message.Id, err)
+			return
+		}
+		c.lock.Lock()
+		c.subscriptions[message.Id] = sub
+		c.lock.Unlock()
+		c.send(wsReply{Op: wsSubscribed, Id: message.Id})
+	case wsUnsubscribe:
+		c.lock.Lock()
+		delete(c.subscriptions, message.Id)
+		c.lock.Unlock()
+		c.send(wsReply{Op: wsUnsubscribed, Id: message.Id})
+	case OpCreate, OpUpdate, OpDelete, OpPublish:
+		c.write(message)
+	default:
+		c.fail(message.Id, fmt.Errorf("%w: unknown op %s", ErrBadRequest, message.Op))
+	}
+}
+
+// subscription checks the principal can read the types subscribed to and filter on the fields.
+func (c *wsClient) subscription(message wsRequest) (subscription, error) {
+	query, err := url.ParseQuery(message.Filter)
+	if err != nil {
+		return subscription{}, fmt.Errorf("%w: invalid filter %s", ErrBadRequest, message.Filter)
+	}
+	sub := subscription{types: message.Types, filters: parseFilters(query)}
+
+	types := c.s.Config.Types
+	if len(sub.types) > 0 {
+		types = make([]Type, 0, len(sub.types))
+		for _, name := range sub.types {
+			t := typeByName(c.s.Config.Types, name)
+			if t == nil {
+				return subscription{}, fmt.Errorf("no type %s: %w", name, ErrNotFound)
+			}
+			err = c.s.can(c.request.Context(), name, ScopeRead)
+			if err != nil {
+				return subscription{}, err
+			}
+			types = append(types, *t)
+		}
+	}
+	for _, t := range types {
+		err = c.s.authorizeFields(c.request.Context(), t, sub.filters.fields())
+		if err != nil {
+			return subscription{}, err
+		}
+	}
+	return sub, nil
+}
+
+// write sends a write to the REST handler for it, as if the principal had requested it, and replies with the
+// response.
+func (c *wsClient) write(message wsRequest) {
+	if typeByName(c.s.Config.Types, message.Type) == nil {
+		c.fail(message.Id, fmt.Errorf("no type %s: %w", message.Type, ErrNotFound))
+		return
+	}
+	if message.Op != OpCreate && message.ObjectId == "" {
+		c.fail(message.Id, fmt.Errorf("%w: %s needs an objectId", ErrBadRequest, message.Op))
+		return
+	}
+
+	path := "/api/" + message.Type + "/" + url.PathEscape(message.ObjectId)
+	method := map[string]string{OpCreate: http.MethodPost, OpUpdate: http.MethodPut, OpDelete: http.MethodDelete, OpPublish: http.MethodPost}[message.Op]
+	switch message.Op {
+	case OpCreate:
+		path = "/api/" + message.Type
+	case OpPublish:
+		path += "/_publish"
+	}
+	body := []byte{}
+	if message.Object != nil {
+		var err error
+		body, err = json.Marshal(message.Object)
+		if err != nil {
+			c.fail(message.Id, err)
+			return
+		}
+	}
+
+	// the request is routed afresh as an internal request, with the principal of the connection
+	ctx, err := c.authenticate()
+	if err != nil {
+		c.fail(message.Id, err)
+		_ = c.conn.Close()
+		return
+	}
+	ctx = context.WithValue(context.WithValue(ctx, chi.RouteCtxKey, nil), internalKey{}, true)
+	request, err := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(body))
+	if err != nil {
+		c.fail(message.Id, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	c.root.ServeHTTP(response, request)
+
+	reply := wsReply{Op: wsResult, Id: message.Id, Status: response.status}
+	if json.Valid(response.body.Bytes()) {
+		reply.Body = response.body.Bytes()
+	}
+	c.send(reply)
+}
+
+// bufferedResponse keeps a response to reply with it over a WebSocket.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
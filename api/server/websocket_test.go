@@ -0,0 +1,149 @@
+package server_test
+
+import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type wsReply struct {
+	Op      string          `json:"op"`
+	Id      string          `json:"id"`
+	Status  int             `json:"status"`
+	Body    json.RawMessage `json:"body"`
+	Message string          `json:"message"`
+	Event   *server.Event   `json:"event"`
+}
+
+func dialWebSocket(t *testing.T, url string, key string) *websocket.Conn {
+	header := http.Header{}
+	if key != "" {
+		header.Set("X-API-Key", key)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(strings.Replace(url, "http", "ws", 1)+"/_ws", header)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func exchange(t *testing.T, conn *websocket.Conn, message string) wsReply {
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(message)))
+	return readReply(t, conn)
+}
+
+func readReply(t *testing.T, conn *websocket.Conn) wsReply {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	var reply wsReply
+	require.NoError(t, conn.ReadJSON(&reply))
+	return reply
+}
+
+func TestServer_WebSocketSubscribesAndWrites(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	url, closeFn := startServer(store, BasicType, DocsType)
+	t.Cleanup(closeFn)
+	conn := dialWebSocket(t, url, "")
+
+	reply := exchange(t, conn, `{"op": "subscribe", "id": "chris", "types": ["user"], "filter": "name=chris"}`)
+	assert.Equal(t, wsReply{Op: "subscribed", Id: "chris"}, reply)
+
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "1", "name": "sam"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs", url), `{"id": "1", "title": "Plan"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	reply = exchange(t, conn, `{"op": "create", "id": "w1", "type": "user", "object": {"id": "2", "name": "chris"}}`)
+	assert.Equal(t, "result", reply.Op)
+	assert.Equal(t, "w1", reply.Id)
+	assert.Equal(t, http.StatusCreated, reply.Status)
+	assert.JSONEq(t, `{"id": "2", "name": "chris"}`, string(reply.Body))
+
+	event := readReply(t, conn)
+	assert.Equal(t, "event", event.Op)
+	assert.Equal(t, "chris", event.Id)
+	require.NotNil(t, event.Event)
+	assert.Equal(t, "create", event.Event.Operation)
+	assert.Equal(t, server.Object{"id": "2", "name": "chris"}, event.Event.Object)
+
+	reply = exchange(t, conn, `{"op": "update", "id": "w2", "type": "user", "objectId": "9", "object": {"id": "9"}}`)
+	assert.Equal(t, http.StatusBadRequest, reply.Status, "validated like the REST api")
+	reply = exchange(t, conn, `{"op": "delete", "id": "w3", "type": "user", "objectId": "2"}`)
+	assert.Equal(t, http.StatusNoContent, reply.Status)
+	event = readReply(t, conn)
+	assert.Equal(t, "delete", event.Event.Operation)
+	assert.Nil(t, event.Event.Object)
+
+	reply = exchange(t, conn, `{"op": "unsubscribe", "id": "chris"}`)
+	assert.Equal(t, "unsubscribed", reply.Op)
+	reply = exchange(t, conn, `{"op": "explode", "id": "x"}`)
+	assert.Equal(t, wsReply{Op: "error", Id: "x", Status: http.StatusBadRequest, Message: "bad request: unknown op explode"}, reply)
+}
+
+func TestServer_WebSocketChecksPermissions(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	url := startConfiguredServer(t, store, []server.Type{BasicType, DocsType}, withAuth(apiKeys))
+
+	_, resp, err := websocket.DefaultDialer.Dial(strings.Replace(url, "http", "ws", 1)+"/_ws", nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	conn := dialWebSocket(t, url, "read-key")
+	reply := exchange(t, conn, `{"op": "subscribe", "id": "docs", "types": ["docs"]}`)
+	assert.Equal(t, "error", reply.Op)
+	assert.Equal(t, http.StatusForbidden, reply.Status)
+	reply = exchange(t, conn, `{"op": "subscribe", "id": "all"}`)
+	assert.Equal(t, "subscribed", reply.Op)
+
+	reply = exchange(t, conn, `{"op": "create", "id": "w1", "type": "user", "object": {"id": "1", "name": "chris"}}`)
+	assert.Equal(t, http.StatusForbidden, reply.Status)
+
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/docs", url), `{"id": "1", "title": "Plan"}`, "admin-key")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/user", url), `{"id": "1", "name": "chris"}`, "admin-key")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	event := readReply(t, conn)
+	assert.Equal(t, "user", event.Event.Type, "docs events can't be read with the key")
+}
+
+func TestServer_WebSocketWritesStopWhenCredentialsExpire(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	url := startConfiguredServer(t, storeWith(t, chris), []server.Type{BasicType}, withJWT(server.JWTConfig{Keys: []string{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))}}))
+
+	c := claims("editor")
+	c["exp"] = time.Now().Add(time.Second).Unix()
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+signToken(t, jwt.SigningMethodES256, "", key, c))
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(url, "http", "ws", 1)+"/_ws", header)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	reply := exchange(t, conn, `{"op": "create", "id": "w1", "type": "user", "object": {"id": "2", "name": "sam"}}`)
+	assert.Equal(t, http.StatusCreated, reply.Status)
+
+	time.Sleep(2 * time.Second)
+	reply = exchange(t, conn, `{"op": "create", "id": "w2", "type": "user", "object": {"id": "3", "name": "alex"}}`)
+	assert.Equal(t, "error", reply.Op)
+	assert.Equal(t, http.StatusUnauthorized, reply.Status)
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err, "the connection is closed")
+}
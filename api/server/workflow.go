@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// WorkflowDraft makes writes to a type create drafts, which are only published by an explicit publish.
+const WorkflowDraft = "draft"
+
+// Stages of objects of types with a draft workflow.
+const (
+	// StageDraft is the latest version of each object, its draft when it has one.
+	StageDraft = "draft"
+	// StagePublished only has the published objects.
+	StagePublished = "published"
+)
+
+// draftType is the type drafts of t are stored as, so providers keep them apart from the published objects,
+// e.g. under pets/_draft/ on Google Cloud. Drafts aren't searched and only have to be unique once published.
+func (t Type) draftType() Type {
+	draft := t
+	draft.Name = t.Name + "/_draft"
+	draft.Unique = nil
+	draft.Search = nil
+	draft.Public = false
+	draft.SoftDelete = false
+	return draft
+}
+
+func (t Type) hasDrafts() bool {
+	return t.Workflow == WorkflowDraft
+}
+
+// writeType is the type writes made through the api are stored as.
+func (t Type) writeType() Type {
+	if t.hasDrafts() {
+		return t.draftType()
+	}
+	return t
+}
+
+// parseStage reads the stage query parameter, reads through the api default to the latest versions.
+// Every object of types without a draft workflow is published.
+func parseStage(query url.Values) (string, error) {
+	switch stage := query.Get("stage"); stage {
+	case "":
+		return StageDraft, nil
+	case StageDraft, StagePublished:
+		return stage, nil
+	default:
+		return "", fmt.Errorf("%w: invalid stage %s, expected %s or %s", ErrBadRequest, stage, StageDraft, StagePublished)
+	}
+}
+
+// listStage lists the objects of t matching the filters at the stage: the drafts and the published objects
+// without a draft for StageDraft.
+func (s Server) listStage(t Type, f filters, stage string) ([]Object, error) {
+	published, err := s.list(t, f)
+	if err != nil || !t.hasDrafts() || stage == StagePublished {
+		return published, err
+	}
+
+	drafts, err := s.DataStore.List(t.draftType())
+	if err != nil {
+		return nil, err
+	}
+	drafted := map[string]bool{}
+	latest := make([]Object, 0, len(published)+len(drafts))
+	for _, draft := range drafts {
+		id, _ := IndexValue(draft[t.Id])
+		drafted[id] = true
+		if f.matches(draft) {
+			latest = append(latest, draft)
+		}
+	}
+	for _, obj := range published {
+		id, _ := IndexValue(obj[t.Id])
+		if !drafted[id] {
+			latest = append(latest, obj)
+		}
+	}
+	sortById(t, latest)
+	return latest, nil
+}
+
+// getStage reads an object of t at the stage.
+func (s Server) getStage(t Type, id string, stage string) (Object, error) {
+	if t.hasDrafts() && stage == StageDraft {
+		draft, err := s.DataStore.Get(t.draftType(), id)
+		if err == nil || !errors.Is(err, ErrNotFound) {
+			return draft, err
+		}
+	}
+	return s.DataStore.Get(t, id)
+}
+
+// publish replaces the published version of an object with its draft, which is removed.
+func (s Server) publish(t Type, id string) (Object, error) {
+	draft, err := s.DataStore.Get(t.draftType(), id)
+	if err != nil {
+		return nil, fmt.Errorf("no draft of %s %s to publish: %w", t.Name, id, err)
+	}
+
+	e, err := s.prepare(s.event(t, id, OpPublish, draft))
+	if err != nil {
+		return nil, err
+	}
+	// the published version is written without an event of its own, publishing is a single change
+	write := s.DataStore.Update
+	_, err = s.DataStore.Get(t, id)
+	if errors.Is(err, ErrNotFound) {
+		write, err = s.DataStore.Create, nil
+	}
+	if err == nil {
+		err = s.store(t, id, draft, write)
+	}
+	if err != nil {
+		s.abandon(e)
+		return nil, err
+	}
+	// the draft is published, it is removed without an event of its own too, if this fails the event is left pending
+	// for the outbox relay to settle
+	err = s.DataStore.Delete(t.draftType(), id)
+	if err != nil {
+		return nil, err
+	}
+	s.search.remove(t.draftType(), id)
+	s.emit(e)
+	return draft, nil
+}
+
+// removeDraft deletes the draft of an object when there is one.
+func (s Server) removeDraft(t Type, id string) error {
+	if !t.hasDrafts() {
+		return nil
+	}
+	_, err := s.DataStore.Get(t.draftType(), id)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.remove(t.draftType(), id)
+}
+
+// deleteStages deletes the published version and the draft of an object. The published version goes first, so a
+// delete restricted by its references or permissions leaves the draft in place.
+func (s Server) deleteStages(ctx context.Context, t Type, id string) error {
+	if !t.hasDrafts() {
+		return s.delete(ctx, t, id)
+	}
+	_, err := s.DataStore.Get(t, id)
+	if err == nil {
+		err = s.delete(ctx, t, id)
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	err = s.removeSchedule(t, id)
+	if err != nil {
+		return err
+	}
+	return s.removeDraft(t, id)
+}
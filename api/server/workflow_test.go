@@ -0,0 +1,102 @@
+package server_test
+
+import (
+	"crswty.com/cms/datastore"
+	"crswty.com/cms/server"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var PagesType = server.Type{Name: "pages", Id: "id", Workflow: server.WorkflowDraft, Public: true, Schema:
+// language=json
+`{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"id": { "type": "string" },
+		"title": { "type": "string" }
+	}
+}`}
+
+func TestServer_WritesCreateDraftsUntilPublished(t *testing.T) {
+	store, err := datastore.NewMemory(datastore.Record{Type: PagesType, Id: "1", Data: server.Object{"id": "1", "title": "Home"}})
+	require.NoError(t, err)
+	url, closeFn := startServer(store, PagesType)
+	defer closeFn()
+	content := strings.TrimSuffix(url, "/api") + "/content"
+
+	resp := authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/1", url), `{"id": "1", "title": "Welcome"}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.Post(fmt.Sprintf("%s/pages", url), "application/json", strings.NewReader(`{"id": "2", "title": "About"}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	assert.JSONEq(t, `[{"id": "1", "title": "Welcome"}, {"id": "2", "title": "About"}]`, getBody(t, fmt.Sprintf("%s/pages", url), http.StatusOK))
+	assert.JSONEq(t, `[{"id": "1", "title": "Home"}]`, getBody(t, fmt.Sprintf("%s/pages?stage=published", url), http.StatusOK))
+	assert.JSONEq(t, `{"id": "1", "title": "Welcome"}`, getBody(t, fmt.Sprintf("%s/pages/1?stage=draft", url), http.StatusOK))
+	assert.JSONEq(t, `{"id": "1", "title": "Home"}`, getBody(t, fmt.Sprintf("%s/pages/1?stage=published", url), http.StatusOK))
+	getBody(t, fmt.Sprintf("%s/pages/2?stage=published", url), http.StatusNotFound)
+	assert.JSONEq(t, `[{"id": "1", "title": "Home"}]`, getBody(t, fmt.Sprintf("%s/pages", content), http.StatusOK))
+
+	stored, err := store.Get(server.Type{Name: "pages/_draft"}, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "Welcome", stored["title"])
+
+	resp, err = http.Post(fmt.Sprintf("%s/pages/1/_publish", url), "application/json", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"id": "1", "title": "Welcome"}`, readBody(t, resp))
+	assert.JSONEq(t, `[{"id": "1", "title": "Welcome"}]`, getBody(t, fmt.Sprintf("%s/pages?stage=published", url), http.StatusOK))
+	assert.JSONEq(t, `{"id": "1", "title": "Welcome"}`, getBody(t, fmt.Sprintf("%s/pages/1", content), http.StatusOK))
+
+	resp, err = http.Post(fmt.Sprintf("%s/pages/1/_publish", url), "application/json", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	getBody(t, fmt.Sprintf("%s/pages?stage=live", url), http.StatusBadRequest)
+}
+
+func TestServer_PublishEmitsOneEvent(t *testing.T) {
+	store, err := datastore.NewMemory()
+	require.NoError(t, err)
+	url, closeFn := startServer(store, PagesType)
+	t.Cleanup(closeFn)
+	messages := openEvents(t, fmt.Sprintf("%s/_events", url), "", "")
+
+	resp := authRequest(t, http.MethodPost, fmt.Sprintf("%s/pages", url), `{"id": "1", "title": "Home"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/pages/1/_publish", url), "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = authRequest(t, http.MethodPost, fmt.Sprintf("%s/pages", url), `{"id": "2", "title": "About"}`, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	assert.Equal(t, "create", nextMessage(t, messages).event)
+	message := nextMessage(t, messages)
+	assert.Equal(t, "publish", message.event)
+	assert.Equal(t, "2", message.id)
+	message = nextMessage(t, messages)
+	assert.Equal(t, "create", message.event, "removing the published draft isn't an event of its own")
+	assert.Equal(t, "3", message.id)
+}
+
+func TestServer_DeleteRemovesDraftAndPublished(t *testing.T) {
+	store, err := datastore.NewMemory(datastore.Record{Type: PagesType, Id: "1", Data: server.Object{"id": "1", "title": "Home"}})
+	require.NoError(t, err)
+	url, closeFn := startServer(store, PagesType)
+	defer closeFn()
+
+	resp := authRequest(t, http.MethodPut, fmt.Sprintf("%s/pages/1", url), `{"id": "1", "title": "Welcome"}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.Post(fmt.Sprintf("%s/pages", url), "application/json", strings.NewReader(`{"id": "2", "title": "About"}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	require.Equal(t, http.StatusNoContent, deleteRequest(t, fmt.Sprintf("%s/pages/1", url)).StatusCode)
+	require.Equal(t, http.StatusNoContent, deleteRequest(t, fmt.Sprintf("%s/pages/2", url)).StatusCode)
+	assert.JSONEq(t, `[]`, getBody(t, fmt.Sprintf("%s/pages", url), http.StatusOK))
+	assert.JSONEq(t, `[]`, getBody(t, fmt.Sprintf("%s/pages?stage=published", url), http.StatusOK))
+}
@@ -0,0 +1,57 @@
+package server
+
+// create, update and remove are the paths every write made by the server goes through,
+// keeping everything derived from the stored objects, such as the search index and history, up to date and
+// publishing the change as an event. With the outbox on, the event is recorded before the write is made.
+
+func (s Server) create(t Type, id string, obj Object) error {
+	return s.put(t, id, obj, OpCreate, s.DataStore.Create)
+}
+
+func (s Server) update(t Type, id string, obj Object) error {
+	return s.put(t, id, obj, OpUpdate, s.DataStore.Update)
+}
+
+// put writes obj with write, publishing it as an event of the operation.
+func (s Server) put(t Type, id string, obj Object, operation string, write func(Type, string, Object) error) error {
+	e, err := s.prepare(s.event(t, id, operation, obj))
+	if err != nil {
+		return err
+	}
+	err = s.store(t, id, obj, write)
+	if err != nil {
+		s.abandon(e)
+		return err
+	}
+	s.emit(e)
+	return s.record(t, id, obj)
+}
+
+// store writes obj with write and indexes it for search, the caller publishes the change.
+func (s Server) store(t Type, id string, obj Object, write func(Type, string, Object) error) error {
+	err := write(t, id, obj)
+	if err != nil {
+		return err
+	}
+	s.search.put(t, id, obj)
+	return nil
+}
+
+func (s Server) remove(t Type, id string) error {
+	var before Object
+	if s.events != nil {
+		before, _ = s.DataStore.Get(t, id)
+	}
+	e, err := s.prepare(s.event(t, id, OpDelete, before))
+	if err != nil {
+		return err
+	}
+	err = s.DataStore.Delete(t, id)
+	if err != nil {
+		s.abandon(e)
+		return err
+	}
+	s.search.remove(t, id)
+	s.emit(e)
+	return nil
+}
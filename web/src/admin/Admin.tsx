@@ -2,7 +2,7 @@ import React, {FunctionComponent, useEffect, useState} from "react";
 import {ApiDescription, ApiType} from "../types";
 import jsonServerProvider from "ra-data-json-server";
 import {CustomTheme} from "../theme/customTheme";
-import {Datagrid, DeleteButton, EditButton, List, Resource, TextField, Admin as ReactAdmin} from "react-admin";
+import {Datagrid, DeleteButton, EditButton, List, Resource, TextField, Admin as ReactAdmin, fetchUtils} from "react-admin";
 import {JsrfCreate, JsrfEdit} from "../jsrf/JsrfEdit";
 import {flattenSchema} from "../schema/json-schema";
 
@@ -10,14 +10,37 @@ type AdminProps = {
     server: string
 }
 
+// the session cookie is sent by the browser, unsafe requests also need the CSRF token the server set with it
+const csrfToken = () => document.cookie.split("; ")
+    .find((cookie) => cookie.startsWith("cms_csrf="))
+    ?.substring("cms_csrf=".length);
+
+const httpClient = (url: string, options: fetchUtils.Options = {}) => {
+    const headers = new Headers(options.headers || {Accept: "application/json"});
+    const token = csrfToken();
+    if (token) {
+        headers.set("X-CSRF-Token", token);
+    }
+    return fetchUtils.fetchJson(url, {...options, headers, credentials: "same-origin"}).catch((error) => {
+        if (error.status === 401) {
+            window.location.href = "/auth/login?next=" + encodeURIComponent(window.location.pathname);
+        }
+        throw error;
+    });
+};
+
 export const Admin = ({server}: AdminProps) => {
 
-    let data = jsonServerProvider(server);
+    let data = jsonServerProvider(server, httpClient);
     const [apiDescription, setApiDescription] = useState<ApiDescription>({types: []});
 
     useEffect(() => {
         async function getApiDescription() {
-            const response = await fetch(server + "/describe");
+            const response = await fetch(server + "/describe", {credentials: "same-origin"});
+            if (response.status === 401) {
+                window.location.href = "/auth/login?next=" + encodeURIComponent(window.location.pathname);
+                return
+            }
             const body = await response.json();
             setApiDescription(body)
         }